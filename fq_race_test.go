@@ -0,0 +1,150 @@
+package fq_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/postwait/gofq"
+	"github.com/postwait/gofq/fqtest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHooks is safe for concurrent use and simply tallies events.
+type countingHooks struct {
+	auths, binds, unbinds, msgs, disconnects, stats, errors atomic.Int64
+}
+
+func (h *countingHooks) AuthHook(c *fq.Client, err error)             { h.auths.Add(1) }
+func (h *countingHooks) BindHook(c *fq.Client, req *fq.BindReq)       { h.binds.Add(1) }
+func (h *countingHooks) UnbindHook(c *fq.Client, req *fq.UnbindReq)   { h.unbinds.Add(1) }
+func (h *countingHooks) DisconnectHook(c *fq.Client)                  { h.disconnects.Add(1) }
+func (h *countingHooks) StatusHook(c *fq.Client, s map[string]uint32) { h.stats.Add(1) }
+func (h *countingHooks) ErrorLogHook(c *fq.Client, err string)        { h.errors.Add(1) }
+func (h *countingHooks) ErrorHook(c *fq.Client, err error)            { h.errors.Add(1) }
+func (h *countingHooks) MessageHook(c *fq.Client, m *fq.Message) bool { h.msgs.Add(1); return false }
+
+// TestRaceHammer exercises Publish, Bind, Status, the setters and
+// forced reconnects concurrently.  It is most useful under -race.
+func TestRaceHammer(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	hooks := &countingHooks{}
+	fqclient, err := fq.Dial(srv.Addr(),
+		fq.WithCredentials("gotest", "nopass"),
+		fq.WithBacklog(100),
+		fq.WithHeartBeat(50*time.Millisecond),
+		fq.WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	spawn := func(n int, f func(i int)) {
+		for g := 0; g < n; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					f(i)
+				}
+			}()
+		}
+	}
+
+	spawn(4, func(i int) {
+		fqclient.Publish(fq.NewMessage("logging", "test.gotest.race", []byte("RACE")))
+	})
+	spawn(2, func(i int) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		breq := &fq.BindReq{
+			Exchange: fq.Rk("logging"),
+			Flags:    fq.FQ_BIND_TRANS,
+			Program:  "prefix:\"test.gotest.race\"",
+		}
+		if _, err := fqclient.BindContext(ctx, breq); err == nil {
+			fqclient.UnbindContext(ctx, &fq.UnbindReq{Exchange: breq.Exchange, RouteId: breq.OutRouteId})
+		}
+		fqclient.Bind(&fq.BindReq{Exchange: fq.Rk("logging"), Program: "prefix:\"\""})
+	})
+	spawn(2, func(i int) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		fqclient.StatusContext(ctx)
+		fqclient.Status()
+	})
+	spawn(1, func(i int) {
+		fqclient.SetHeartBeat(time.Duration(50+i%50) * time.Millisecond)
+		fqclient.SetNonBlocking(i%2 == 0)
+		fqclient.SetFailoverCooldown(time.Duration(i) * time.Millisecond)
+		fqclient.SetResolveInterval(time.Duration(i+1) * time.Millisecond)
+		fqclient.SetHooks(hooks)
+		fqclient.LastError()
+		fqclient.DataBacklog()
+		fqclient.Receive(false)
+	})
+	spawn(1, func(i int) {
+		time.Sleep(100 * time.Millisecond)
+		srv.DropConnections()
+	})
+
+	time.Sleep(time.Second)
+	close(stop)
+	wg.Wait()
+
+	if hooks.disconnects.Load() == 0 {
+		t.Errorf("expected forced disconnects")
+	}
+
+	// The client must have recovered from the abuse.
+	fqclient.SetNonBlocking(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub := fq.NewClient()
+	sub.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	if err := sub.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+	defer sub.Shutdown()
+	if _, err := sub.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  "exact:\"test.gotest.race.after\"",
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.race.after", []byte("AFTER")))
+	got := make(chan *fq.Message, 1)
+	go func() { got <- sub.Receive(true) }()
+	select {
+	case msg := <-got:
+		if !bytes.Equal(msg.Payload, []byte("AFTER")) {
+			t.Errorf("payload corrupted")
+		}
+	case <-ctx.Done():
+		t.Fatalf("message not delivered after reconnects")
+	}
+
+	done := make(chan bool)
+	go func() {
+		fqclient.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown hung")
+	}
+	if fqclient.Publish(fq.NewMessage("logging", "test", nil)) {
+		t.Errorf("Publish after Shutdown should fail")
+	}
+}
@@ -2,8 +2,22 @@ package fq_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/postwait/gofq"
+	"github.com/postwait/gofq/fqtest"
+	"github.com/postwait/gofq/route"
+	"github.com/postwait/gofq/wire"
 	"log"
+	"math"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -12,7 +26,8 @@ type MyFqHooks struct {
 	test  *testing.T
 	bound chan uint32
 	msgs  chan *fq.Message
-	stats map[string]uint32
+	stats chan map[string]uint32
+	done  atomic.Bool
 }
 
 func (h *MyFqHooks) AuthHook(c *fq.Client, err error) {
@@ -33,13 +48,15 @@ func (h *MyFqHooks) BindHook(c *fq.Client, breq *fq.BindReq) {
 func (h *MyFqHooks) UnbindHook(c *fq.Client, breq *fq.UnbindReq) {
 }
 func (h *MyFqHooks) DisconnectHook(c *fq.Client) {
-	h.test.Errorf("Unexpected disconnect")
+	if !h.done.Load() {
+		h.test.Errorf("Unexpected disconnect")
+	}
 }
 func (h *MyFqHooks) ErrorLogHook(c *fq.Client, err string) {
 	log.Print(err)
 }
 func (h *MyFqHooks) StatusHook(c *fq.Client, stats map[string]uint32) {
-	h.stats = stats
+	h.stats <- stats
 }
 func (h *MyFqHooks) MessageHook(c *fq.Client, msg *fq.Message) bool {
 	h.msgs <- msg
@@ -47,14 +64,18 @@ func (h *MyFqHooks) MessageHook(c *fq.Client, msg *fq.Message) bool {
 }
 
 func TestSendRcv(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
 	hooks := &MyFqHooks{
 		test:  t,
 		bound: make(chan uint32, 1),
 		msgs:  make(chan *fq.Message, 1),
+		stats: make(chan map[string]uint32, 1),
 	}
+	defer hooks.done.Store(true)
 	fqclient := fq.NewClient()
 	fqclient.SetHooks(hooks)
-	fqclient.Creds("localhost", 8765, "gotest", "nopass")
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
 	fqclient.Connect()
 
 	routeid := uint32(0xffffffff)
@@ -82,26 +103,27 @@ func TestSendRcv(t *testing.T) {
 		t.Errorf("Message recv timed out")
 	}
 
-	time.Sleep(250 * time.Millisecond)
-
-	if hooks.stats == nil {
-		t.Errorf("statistics requested, but not found")
-	} else {
-		if _, ok := hooks.stats["routed"]; !ok {
+	select {
+	case stats := <-hooks.stats:
+		if _, ok := stats["routed"]; !ok {
 			t.Errorf("statistic 'routed' missing")
 		}
-		if _, ok := hooks.stats["dropped"]; !ok {
+		if _, ok := stats["dropped"]; !ok {
 			t.Errorf("statistic 'dropped' missing")
 		}
+	case <-time.NewTimer(time.Second).C:
+		t.Errorf("statistics requested, but not found")
 	}
 }
 
 func TestTSHook(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
 	tsh := fq.NewTSHooks()
 	tsh.AddBinding("logging", "prefix:\"test.gotest.tsh\"")
 	fqclient := fq.NewClient()
 	fqclient.SetHooks(&tsh)
-	fqclient.Creds("localhost", 8765, "gotest", "nopass")
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
 	fqclient.Connect()
 
 	time.Sleep(250 * time.Millisecond)
@@ -115,7 +137,7 @@ func TestTSHook(t *testing.T) {
 			}
 			goto OUT
 		case err := <-tsh.ErrorsC:
-			t.Errorf("Error: " + err.Error())
+			t.Errorf("Error: %v", err)
 		case <-time.NewTimer(2 * time.Second).C:
 			t.Errorf("timeout")
 			goto OUT
@@ -125,12 +147,14 @@ OUT:
 }
 
 func TestNonBlocking(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
 	fqclient := fq.NewClient()
 	if fqclient.SetBacklog(1) != 1 {
 		t.Errorf("failed to set backlog down")
 	}
 	fqclient.SetNonBlocking(true)
-	fqclient.Creds("localhost", 8765, "gotest", "nopass")
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
 	fqclient.Connect()
 	dropped := false
 	for i := 0; i < 10; i++ {
@@ -142,11 +166,591 @@ func TestNonBlocking(t *testing.T) {
 	}
 }
 
+func TestOverflowPolicies(t *testing.T) {
+	var spilled []string
+	cases := []struct {
+		name   string
+		policy fq.OverflowPolicy
+		kept   []string
+		stats  fq.OverflowStats
+	}{
+		{"drop newest", fq.OverflowPolicy{Action: fq.OverflowDropNewest},
+			[]string{"0", "1", "2", "3"}, fq.OverflowStats{DroppedNewest: 2}},
+		{"drop oldest", fq.OverflowPolicy{Action: fq.OverflowDropOldest},
+			[]string{"2", "3", "4", "5"}, fq.OverflowStats{DroppedOldest: 2}},
+		{"block timeout", fq.OverflowPolicy{Action: fq.OverflowBlockTimeout, Timeout: 10 * time.Millisecond},
+			[]string{"0", "1", "2", "3"}, fq.OverflowStats{TimedOut: 2}},
+		{"sample none", fq.OverflowPolicy{Action: fq.OverflowSample, SampleAbove: 0.5, SampleRate: 1e-9},
+			[]string{"0", "1"}, fq.OverflowStats{SampledOut: 4}},
+		{"spill", fq.OverflowPolicy{Action: fq.OverflowSpill, Spill: func(msg *fq.Message) {
+			spilled = append(spilled, string(msg.Payload))
+		}}, []string{"0", "1", "2", "3"}, fq.OverflowStats{Spilled: 2}},
+	}
+	for _, tc := range cases {
+		fqclient := fq.NewClient()
+		fqclient.SetBacklog(4)
+		if err := fqclient.SetOverflowPolicy(tc.policy); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		// never connected, so nothing drains the backlog
+		fqclient.Creds("localhost", 8765, "gotest", "nopass")
+		var refused []<-chan error
+		for i := 0; i < 6; i++ {
+			msg := fq.NewMessage("logging", "test", []byte(strconv.Itoa(i)))
+			refused = append(refused, fqclient.PublishAsync(msg))
+		}
+		if stats := fqclient.OverflowStats(); stats != tc.stats {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.stats, stats)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		left, _ := fqclient.Close(ctx)
+		cancel()
+		var kept []string
+		for _, m := range left {
+			kept = append(kept, string(m.Payload))
+		}
+		if !slices.Equal(kept, tc.kept) {
+			t.Errorf("%s: expected %v queued, got %v", tc.name, tc.kept, kept)
+		}
+		full := 0
+		for _, done := range refused {
+			if errors.Is(<-done, fq.ErrBacklogFull) {
+				full++
+			}
+		}
+		if want := 6 - len(tc.kept); full != want {
+			t.Errorf("%s: expected %d refused, got %d", tc.name, want, full)
+		}
+	}
+	if !slices.Equal(spilled, []string{"4", "5"}) {
+		t.Errorf("expected 4 and 5 spilled, got %v", spilled)
+	}
+}
+
+func TestReceivePolicySynchronous(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	hooks := &syncHooks{}
+	fqclient, err := fq.Dial(srv.Addr(),
+		fq.WithCredentials("gotest", "nopass"),
+		fq.WithBacklog(2),
+		fq.WithHooks(hooks),
+		fq.WithSynchronous(),
+		fq.WithReceivePolicy(fq.ReceivePolicy{Action: fq.OverflowDropOldest}))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fqclient.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := fqclient.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.synchooks"`,
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		fqclient.Publish(fq.NewMessage("logging", "test.gotest.synchooks", []byte(strconv.Itoa(i))))
+	}
+	waitFor(t, ctx, "drops", func() bool { return fqclient.ReceiveStats().DroppedOldest == 3 })
+
+	// With the backlog full and nobody calling Receive, hooks are
+	// still queued, however many, and commands still answered.
+	const statuses = 1200
+	for i := 0; i < statuses; i++ {
+		fqclient.Status()
+	}
+	if _, err := fqclient.StatusContext(ctx); err != nil {
+		t.Fatalf("StatusContext: %v", err)
+	}
+
+	var msgs []*fq.Message
+	pump(t, fqclient, &msgs, "hooks and messages", func() bool {
+		return count(hooks.events, "status") == statuses && len(msgs) == 2
+	})
+	if hooks.events[0] != "auth" {
+		t.Errorf("expected auth first, got %v", hooks.events)
+	}
+	if string(msgs[0].Payload) != "3" || string(msgs[1].Payload) != "4" {
+		t.Errorf("expected the newest messages, got %q, %q", msgs[0].Payload, msgs[1].Payload)
+	}
+}
+
+// backlogHooks leaves received messages to Receive and records
+// backlog warnings.
+type backlogHooks struct {
+	fq.Hooks
+	warnings chan int
+}
+
+func (h *backlogHooks) MessageHook(c *fq.Client, msg *fq.Message) bool {
+	return false
+}
+func (h *backlogHooks) BacklogHook(c *fq.Client, backlog int) {
+	h.warnings <- backlog
+}
+
+func TestReceivePolicies(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	cases := []struct {
+		name   string
+		action fq.OverflowAction
+		kept   []string
+		stats  fq.OverflowStats
+	}{
+		{"drop newest", fq.OverflowDropNewest, []string{"0", "1", "2", "3"}, fq.OverflowStats{DroppedNewest: 6}},
+		{"drop oldest", fq.OverflowDropOldest, []string{"6", "7", "8", "9"}, fq.OverflowStats{DroppedOldest: 6}},
+	}
+	for _, tc := range cases {
+		tsh := fq.NewTSHooks()
+		hooks := &backlogHooks{Hooks: &tsh, warnings: make(chan int, 10)}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		fqclient, err := fq.Dial(srv.Addr(),
+			fq.WithCredentials("gotest", "nopass"),
+			fq.WithBacklog(4),
+			fq.WithHooks(hooks),
+			fq.WithReceivePolicy(fq.ReceivePolicy{Action: tc.action, WarnAbove: 2}))
+		if err != nil {
+			t.Fatalf("%s: Dial: %v", tc.name, err)
+		}
+		if _, err := fqclient.BindContext(ctx, &fq.BindReq{
+			Exchange: fq.Rk("logging"),
+			Flags:    fq.FQ_BIND_TRANS,
+			Program:  `exact:"test.gotest.backlog"`,
+		}); err != nil {
+			t.Fatalf("%s: BindContext: %v", tc.name, err)
+		}
+		for i := 0; i < 10; i++ {
+			fqclient.Publish(fq.NewMessage("logging", "test.gotest.backlog", []byte(strconv.Itoa(i))))
+		}
+		// Nothing is received until all are in, so the data
+		// connection must keep being read.
+		for fqclient.ReceiveStats() != tc.stats {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("%s: expected %+v, got %+v", tc.name, tc.stats, fqclient.ReceiveStats())
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		var kept []string
+		for msg := fqclient.Receive(false); msg != nil; msg = fqclient.Receive(false) {
+			kept = append(kept, string(msg.Payload))
+		}
+		if !slices.Equal(kept, tc.kept) {
+			t.Errorf("%s: expected %v received, got %v", tc.name, tc.kept, kept)
+		}
+		select {
+		case backlog := <-hooks.warnings:
+			if backlog != 3 {
+				t.Errorf("%s: expected a warning at 3, got %d", tc.name, backlog)
+			}
+		default:
+			t.Errorf("%s: no backlog warning", tc.name)
+		}
+		if len(hooks.warnings) != 0 {
+			t.Errorf("%s: expected one backlog warning, got %d more", tc.name, len(hooks.warnings))
+		}
+		fqclient.Close(ctx)
+		cancel()
+	}
+}
+
+func TestReceiveWarnPerQueue(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	tsh := fq.NewTSHooks()
+	hooks := &backlogHooks{Hooks: &tsh, warnings: make(chan int, 10)}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	fqclient, err := fq.Dial(srv.Addr(),
+		fq.WithCredentials("gotest", "nopass"),
+		fq.WithBacklog(4),
+		fq.WithHooks(hooks),
+		fq.WithReceivePolicy(fq.ReceivePolicy{Action: fq.OverflowDropNewest, WarnAbove: 2}))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fqclient.Close(ctx)
+	for _, r := range []string{"a", "b"} {
+		if _, err := fqclient.Subscribe(ctx, "logging", `exact:"test.gotest.warn.`+r+`"`); err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+	}
+	if _, err := fqclient.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.warn.other"`,
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	// Each queue in turn grows beyond WarnAbove while the others
+	// are still full, and is warned about.
+	queues := []string{"a", "b", "other"}
+	for _, r := range queues {
+		for i := 0; i < 2; i++ {
+			fqclient.Publish(fq.NewMessage("logging", "test.gotest.warn."+r, nil))
+		}
+	}
+	for _, r := range queues {
+		fqclient.Publish(fq.NewMessage("logging", "test.gotest.warn."+r, nil))
+		select {
+		case backlog := <-hooks.warnings:
+			if backlog != 3 {
+				t.Errorf("%s: expected a warning at 3, got %d", r, backlog)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%s: no backlog warning", r)
+		}
+	}
+	if len(hooks.warnings) != 0 {
+		t.Errorf("expected one warning per queue, got %d more", len(hooks.warnings))
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	// Rebinding is disabled, but Subscriptions are rebound regardless.
+	fqclient, err := fq.Dial(srv.Addr(), fq.WithCredentials("gotest", "nopass"), fq.WithoutRebind())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var le *fq.LimitError
+	if _, err := fqclient.Subscribe(ctx, strings.Repeat("x", fq.FQ_MAX_RK_LEN+1), `prefix:""`); !errors.As(err, &le) {
+		t.Errorf("expected a *LimitError for a long exchange, got %v", err)
+	}
+	sub, err := fqclient.Subscribe(ctx, "logging", `exact:"test.gotest.sub"`)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case msg := <-sub.C:
+			if string(msg.Payload) != want {
+				t.Errorf("expected %q, got %q", want, msg.Payload)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%q not received", want)
+		}
+	}
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.sub", []byte("one")))
+	receive("one")
+
+	// The subscription follows its binding to a new route.
+	route := fqclient.Bindings()[0].OutRouteId
+	srv.DropConnections()
+	waitFor(t, ctx, "rebind", func() bool {
+		b := fqclient.Bindings()
+		return len(b) == 1 && b[0].OutRouteId != route
+	})
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.sub", []byte("two")))
+	receive("two")
+
+	if err := sub.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if _, ok := <-sub.C; ok || sub.Err() != nil {
+		t.Errorf("expected C closed without error, got %v", sub.Err())
+	}
+	if b := fqclient.Bindings(); len(b) != 0 {
+		t.Errorf("expected no bindings, got %v", b)
+	}
+	if err := sub.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// The iterator closes its subscription when done.
+	go func() {
+		for len(fqclient.Bindings()) == 0 && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, p := range []string{"a", "b", "c"} {
+			fqclient.Publish(fq.NewMessage("logging", "test.gotest.seq", []byte(p)))
+		}
+	}()
+	var got []string
+	for msg, err := range fqclient.Messages(ctx, "logging", `exact:"test.gotest.seq"`) {
+		if err != nil {
+			t.Fatalf("Messages: %v", err)
+		}
+		if got = append(got, string(msg.Payload)); len(got) == 3 {
+			break
+		}
+	}
+	if !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("expected a, b, c, got %v", got)
+	}
+	if b := fqclient.Bindings(); len(b) != 0 {
+		t.Errorf("expected no bindings, got %v", b)
+	}
+
+	// Closing the Client ends its subscriptions.
+	sub, err = fqclient.Subscribe(ctx, "logging", `exact:"test.gotest.sub"`)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	fqclient.Close(ctx)
+	for _, err := range sub.All() {
+		if !errors.Is(err, fq.ErrClosed) {
+			t.Errorf("expected ErrClosed, got %v", err)
+		}
+	}
+	if _, err := fqclient.Subscribe(ctx, "logging", `exact:"test.gotest.sub"`); !errors.Is(err, fq.ErrClosed) {
+		t.Errorf("expected ErrClosed subscribing after Close, got %v", err)
+	}
+}
+
+func TestSubscribeFuncClose(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient, err := fq.Dial(srv.Addr(), fq.WithCredentials("gotest", "nopass"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fqclient.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The handler stops its Subscription after two messages.
+	var sub *fq.Subscription
+	var handled atomic.Int32
+	closed := make(chan error, 1)
+	ready := make(chan struct{})
+	sub, err = fqclient.SubscribeFunc(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.func"`,
+	}, func(msg *fq.Message) {
+		<-ready
+		if handled.Add(1) == 2 {
+			closed <- sub.Close()
+		}
+	})
+	if err != nil {
+		t.Fatalf("SubscribeFunc: %v", err)
+	}
+	close(ready)
+	for i := 0; i < 3; i++ {
+		fqclient.Publish(fq.NewMessage("logging", "test.gotest.func", []byte(strconv.Itoa(i))))
+	}
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Close from handler: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Close from handler did not return")
+	}
+
+	// The data connection still delivers.
+	next, err := fqclient.Subscribe(ctx, "logging", `exact:"test.gotest.func.next"`)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.func.next", []byte("next")))
+	select {
+	case <-next.C:
+	case <-ctx.Done():
+		t.Fatalf("message after handler Close not received")
+	}
+	if n := handled.Load(); n != 2 {
+		t.Errorf("expected 2 messages handled, got %d", n)
+	}
+}
+
+func TestMessagesDisconnected(t *testing.T) {
+	srv := fqtest.NewServer()
+	fqclient, err := fq.Dial(srv.Addr(), fq.WithCredentials("gotest", "nopass"),
+		fq.WithDialTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer func() {
+		// there is nothing left to drain to
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		fqclient.Close(ctx)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		for len(fqclient.Bindings()) == 0 && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		fqclient.Publish(fq.NewMessage("logging", "test.gotest.gone", []byte("gone")))
+	}()
+	start := time.Now()
+	for _, err := range fqclient.Messages(ctx, "logging", `exact:"test.gotest.gone"`) {
+		if err != nil {
+			t.Fatalf("Messages: %v", err)
+		}
+		// Leave while there is no server to unbind from.
+		srv.Close()
+		break
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("closing the subscription took %v", elapsed)
+	}
+	if b := fqclient.Bindings(); len(b) != 0 {
+		t.Errorf("expected no bindings, got %v", b)
+	}
+}
+
+func TestDemux(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient, err := fq.Dial(srv.Addr(), fq.WithCredentials("gotest", "nopass"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fqclient.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a is told apart by its filter, evaluated locally
+	a, err := fqclient.SubscribeBind(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Route:    route.MustParse(`prefix:"test.gotest.demux." {route_contains("a")}`),
+	})
+	if err != nil {
+		t.Fatalf("SubscribeBind: %v", err)
+	}
+	handled := make(chan string, 10)
+	b, err := fqclient.SubscribeFunc(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.demux.b"`,
+	}, func(msg *fq.Message) {
+		handled <- string(msg.Payload)
+	})
+	if err != nil {
+		t.Fatalf("SubscribeFunc: %v", err)
+	}
+	// all overlaps both, and gets its own copy
+	all, err := fqclient.Subscribe(ctx, "logging", `prefix:"test.gotest.demux."`)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	routes := map[uint32]bool{a.RouteId(): true, b.RouteId(): true, all.RouteId(): true}
+	if len(routes) != 3 {
+		t.Errorf("expected distinct route ids, got %v", routes)
+	}
+	// other has no Subscription, so goes to Receive
+	other, err := fqclient.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.other"`,
+	})
+	if err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+
+	for _, r := range []string{"test.gotest.demux.a", "test.gotest.demux.b", "test.gotest.other"} {
+		fqclient.Publish(fq.NewMessage("logging", r, []byte(r)))
+	}
+	next := func(c <-chan *fq.Message) string {
+		t.Helper()
+		select {
+		case msg := <-c:
+			payload := string(msg.Payload)
+			msg.Release()
+			return payload
+		case <-ctx.Done():
+			t.Fatalf("message not received")
+			return ""
+		}
+	}
+	if got := next(a.C); got != "test.gotest.demux.a" {
+		t.Errorf("a: unexpected %q", got)
+	}
+	select {
+	case got := <-handled:
+		if got != "test.gotest.demux.b" {
+			t.Errorf("b: unexpected %q", got)
+		}
+	case <-ctx.Done():
+		t.Fatalf("b: message not handled")
+	}
+	for _, want := range []string{"test.gotest.demux.a", "test.gotest.demux.b"} {
+		if got := next(all.C); got != want {
+			t.Errorf("all: expected %q, got %q", want, got)
+		}
+	}
+	received := make(chan *fq.Message, 1)
+	go func() { received <- fqclient.Receive(true) }()
+	msg := <-received
+	if string(msg.Payload) != "test.gotest.other" {
+		t.Errorf("Receive: unexpected %q", msg.Payload)
+	}
+	if b, ok := fqclient.BindingFor(msg); !ok || b.OutRouteId != other {
+		t.Errorf("expected binding %d, got %v, %v", other, b, ok)
+	}
+	if len(a.C) != 0 || len(handled) != 0 || len(all.C) != 0 {
+		t.Errorf("unexpected extra messages")
+	}
+}
+
+func TestDemuxSampled(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient, err := fq.Dial(srv.Addr(), fq.WithCredentials("gotest", "nopass"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fqclient.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The server samples; every message it routes must reach s, not
+	// be sampled a second time on the way.
+	s, err := fqclient.SubscribeBind(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Route:    route.MustParse(`prefix:"test.gotest.sampled." {sample(0.5)}`),
+	})
+	if err != nil {
+		t.Fatalf("SubscribeBind: %v", err)
+	}
+	if _, err := fqclient.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.sampled"`,
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		fqclient.Publish(fq.NewMessage("logging", fmt.Sprintf("test.gotest.sampled.%d", i), nil))
+	}
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.sampled", []byte("end")))
+
+	received := make(chan *fq.Message, 1)
+	go func() { received <- fqclient.Receive(true) }()
+	select {
+	case msg := <-received:
+		if string(msg.Payload) != "end" {
+			t.Errorf("Receive: sampled message %s leaked", msg.Route.ToString())
+		}
+	case <-ctx.Done():
+		t.Fatalf("Receive: message not received")
+	}
+	if len(s.C) == 0 {
+		t.Errorf("no sampled messages delivered")
+	}
+}
+
 func TestHeartbeat(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
 	tsh := fq.NewTSHooks()
 	fqclient := fq.NewClient()
 	fqclient.SetHooks(&tsh)
-	fqclient.Creds("localhost", 8765, "gotest", "nopass")
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
 	fqclient.SetHeartBeat(250 * time.Millisecond)
 	fqclient.Connect()
 
@@ -156,7 +760,7 @@ func TestHeartbeat(t *testing.T) {
 	for {
 		select {
 		case err := <-tsh.ErrorsC:
-			if err.Error() == "dead: missing heartbeat" {
+			if errors.Is(err, fq.ErrHeartbeatTimeout) {
 				passed = true
 				goto OUT
 			}
@@ -169,3 +773,1319 @@ OUT:
 		t.Errorf("Failed to notice stopped heartbeat")
 	}
 }
+
+func TestContextCommands(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient := fq.NewClient()
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+
+	breq := &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  "prefix:\"test.gotest.ctx\"",
+	}
+	routeid, err := fqclient.BindContext(ctx, breq)
+	if err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	if routeid == fq.FQ_BIND_ILLEGAL || routeid != breq.OutRouteId {
+		t.Errorf("unexpected route id %d (req %d)", routeid, breq.OutRouteId)
+	}
+
+	bad := &fq.BindReq{Exchange: fq.Rk("logging"), Program: "bogus"}
+	if routeid, err := fqclient.BindContext(ctx, bad); !errors.Is(err, fq.ErrBindFailed) || routeid != fq.FQ_BIND_ILLEGAL {
+		t.Errorf("illegal program should fail, got %d, %v", routeid, err)
+	}
+
+	msg := fq.NewMessage("logging", "test.gotest.ctx", []byte("CTX"))
+	fqclient.Publish(msg)
+	done := make(chan *fq.Message, 1)
+	go func() { done <- fqclient.Receive(true) }()
+	select {
+	case nmsg := <-done:
+		if !bytes.Equal(nmsg.Payload, msg.Payload) {
+			t.Errorf("payload corrupted")
+		}
+	case <-ctx.Done():
+		t.Fatalf("Message recv timed out")
+	}
+
+	stats, err := fqclient.StatusContext(ctx)
+	if err != nil {
+		t.Fatalf("StatusContext: %v", err)
+	}
+	if stats["routed"] == 0 {
+		t.Errorf("expected routed messages in %v", stats)
+	}
+
+	ureq := &fq.UnbindReq{Exchange: fq.Rk("logging"), RouteId: routeid}
+	if err := fqclient.UnbindContext(ctx, ureq); err != nil {
+		t.Errorf("UnbindContext: %v", err)
+	}
+	if err := fqclient.UnbindContext(ctx, ureq); !errors.Is(err, fq.ErrUnbindFailed) {
+		t.Errorf("second unbind should fail")
+	}
+}
+
+func TestBindRoute(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient := fq.NewClient()
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+	breq := &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Route: route.Prefix("test.gotest.route").
+			Where(route.Not(route.Call("payload_prefix", "NO"))).
+			MustCompile(),
+	}
+	if _, err := fqclient.BindContext(ctx, breq); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	if breq.Program != `prefix:"test.gotest.route" {!payload_prefix("NO")}` {
+		t.Errorf("unexpected program %s", breq.Program)
+	}
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.other", []byte("OTHER")))
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.route", []byte("NO")))
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.route", []byte("YES")))
+	done := make(chan *fq.Message, 1)
+	go func() { done <- fqclient.Receive(true) }()
+	select {
+	case msg := <-done:
+		if !bytes.Equal(msg.Payload, []byte("YES")) {
+			t.Errorf("unexpected message %s", msg.Payload)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Message recv timed out")
+	}
+}
+
+type rebindHooks struct {
+	countingHooks
+	rebound chan [2]uint32
+}
+
+func (h *rebindHooks) RebindHook(c *fq.Client, req *fq.BindReq, oldRouteId uint32) {
+	h.rebound <- [2]uint32{oldRouteId, req.OutRouteId}
+}
+
+func TestRebind(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	hooks := &rebindHooks{rebound: make(chan [2]uint32, 10)}
+	fqclient, err := fq.Dial(srv.Addr(), fq.WithCredentials("gotest", "nopass"), fq.WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fqclient.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	bind := func() uint32 {
+		routeid, err := fqclient.BindContext(ctx, &fq.BindReq{
+			Exchange: fq.Rk("logging"),
+			Flags:    fq.FQ_BIND_TRANS,
+			Program:  "prefix:\"test.gotest.rebind\"",
+		})
+		if err != nil {
+			t.Fatalf("BindContext: %v", err)
+		}
+		return routeid
+	}
+	routeid := bind()
+	if _, err := fqclient.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_PERM,
+		Program:  "prefix:\"test.gotest.perm\"",
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	// Binding the same again is counted, not replayed twice, and
+	// unbinding either route leaves the other replayed.
+	dup := bind()
+	if b := fqclient.Bindings(); len(b) != 1 || b[0].OutRouteId != routeid {
+		t.Fatalf("unexpected bindings %v", b)
+	}
+	if err := fqclient.UnbindContext(ctx, &fq.UnbindReq{Exchange: fq.Rk("logging"), RouteId: routeid}); err != nil {
+		t.Fatalf("UnbindContext: %v", err)
+	}
+	if b := fqclient.Bindings(); len(b) != 1 || b[0].OutRouteId != dup {
+		t.Fatalf("live duplicate not tracked: %v", b)
+	}
+	dup2 := bind()
+
+	srv.DropConnections()
+	var ids [2]uint32
+	old := map[uint32]bool{}
+	for len(old) < 2 {
+		select {
+		case r := <-hooks.rebound:
+			if ids[1] != 0 && r[1] != ids[1] {
+				t.Fatalf("binding replayed twice: %v, %v", ids, r)
+			}
+			ids = r
+			old[r[0]] = true
+		case <-ctx.Done():
+			t.Fatalf("binding not replayed")
+		}
+	}
+	if !old[dup] || !old[dup2] || ids[1] == dup || ids[1] == dup2 || ids[1] == fq.FQ_BIND_ILLEGAL {
+		t.Errorf("unexpected rebind %v -> %d", old, ids[1])
+	}
+	if b := fqclient.Bindings(); len(b) != 1 || b[0].OutRouteId != ids[1] {
+		t.Fatalf("unexpected bindings %v", b)
+	}
+
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.rebind", []byte("REBIND")))
+	done := make(chan *fq.Message, 1)
+	go func() { done <- fqclient.Receive(true) }()
+	select {
+	case msg := <-done:
+		if !bytes.Equal(msg.Payload, []byte("REBIND")) {
+			t.Errorf("payload corrupted")
+		}
+	case <-ctx.Done():
+		t.Fatalf("Message recv timed out")
+	}
+
+	if err := fqclient.UnbindContext(ctx, &fq.UnbindReq{Exchange: fq.Rk("logging"), RouteId: ids[1]}); err != nil {
+		t.Fatalf("UnbindContext: %v", err)
+	}
+	if b := fqclient.Bindings(); len(b) != 0 {
+		t.Errorf("unbound route still tracked: %v", b)
+	}
+}
+
+func TestConnectContextTimeout(t *testing.T) {
+	srv := fqtest.NewServer()
+	fqclient := fq.NewClient()
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if _, err := fqclient.StatusContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestConnectContextAuthFailure(t *testing.T) {
+	srv := fqtest.NewUnstartedServer()
+	srv.Auth = func(user, pass string) bool { return pass == "secret" }
+	srv.Start()
+	defer srv.Close()
+	fqclient := fq.NewClient()
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); !errors.Is(err, fq.ErrAuthFailed) {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+}
+
+type reentrantHooks struct {
+	countingHooks
+	errs chan error
+}
+
+func (h *reentrantHooks) AuthHook(c *fq.Client, err error) {
+	_, err = c.BindContext(context.Background(), &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `prefix:"test.gotest.reentrant."`,
+	})
+	h.errs <- err
+}
+
+func TestContextFromHook(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	hooks := &reentrantHooks{errs: make(chan error, 10)}
+	fqclient, err := fq.Dial(srv.Addr(), fq.WithCredentials("gotest", "nopass"), fq.WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fqclient.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	select {
+	case err := <-hooks.errs:
+		if !errors.Is(err, fq.ErrWouldDeadlock) {
+			t.Errorf("expected ErrWouldDeadlock, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("BindContext from AuthHook did not return")
+	}
+	// The Client is not wedged, and other go routines are not refused.
+	if _, err := fqclient.StatusContext(ctx); err != nil {
+		t.Errorf("StatusContext: %v", err)
+	}
+}
+
+func TestCloseDrains(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient := fq.NewClient()
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	fqclient.Connect()
+
+	for i := 0; i < 100; i++ {
+		fqclient.Publish(fq.NewMessage("logging", "test.gotest.close", []byte("CLOSE")))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	left, err := fqclient.Close(ctx)
+	if err != nil || len(left) != 0 {
+		t.Fatalf("Close: %d undelivered, %v", len(left), err)
+	}
+	for srv.Stats()["msgs_in"] < 100 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("only %d messages published", srv.Stats()["msgs_in"])
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if left, err := fqclient.Close(ctx); err != nil || len(left) != 0 {
+		t.Errorf("second Close: %d undelivered, %v", len(left), err)
+	}
+	if fqclient.Publish(fq.NewMessage("logging", "test", nil)) {
+		t.Errorf("Publish after Close should fail")
+	}
+}
+
+func TestCloseDeadline(t *testing.T) {
+	srv := fqtest.NewServer()
+	fqclient := fq.NewClient()
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	srv.Close()
+	fqclient.Connect()
+
+	for i := 0; i < 5; i++ {
+		fqclient.Publish(fq.NewMessage("logging", "test.gotest.close", []byte{byte(i)}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	left, err := fqclient.Close(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %v", elapsed)
+	}
+	if len(left) != 5 {
+		t.Fatalf("expected 5 undelivered messages, got %d", len(left))
+	}
+	for i, msg := range left {
+		if msg.Payload[0] != byte(i) {
+			t.Errorf("undelivered message %d out of order", i)
+		}
+	}
+	if left, err := fqclient.Close(ctx); err != nil || len(left) != 0 {
+		t.Errorf("second Close: %d undelivered, %v", len(left), err)
+	}
+}
+
+func TestPublishAsync(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient := fq.NewClient()
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	fqclient.Connect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	select {
+	case err := <-fqclient.PublishAsync(fq.NewMessage("logging", "test.gotest.async", []byte("ASYNC"))):
+		if err != nil {
+			t.Errorf("PublishAsync: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("PublishAsync not confirmed")
+	}
+
+	fqclient.Close(ctx)
+	if err := <-fqclient.PublishAsync(fq.NewMessage("logging", "test", nil)); !errors.Is(err, fq.ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPublishAsyncUndelivered(t *testing.T) {
+	srv := fqtest.NewServer()
+	fqclient := fq.NewClient()
+	fqclient.SetBacklog(2)
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	fqclient.SetNonBlocking(true)
+	srv.Close()
+	fqclient.Connect()
+
+	var pending []<-chan error
+	for i := 0; i < 2; i++ {
+		pending = append(pending, fqclient.PublishAsync(fq.NewMessage("logging", "test.gotest.async", nil)))
+	}
+	if err := <-fqclient.PublishAsync(fq.NewMessage("logging", "test", nil)); !errors.Is(err, fq.ErrBacklogFull) {
+		t.Errorf("expected ErrBacklogFull, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if left, _ := fqclient.Close(ctx); len(left) != len(pending) {
+		t.Fatalf("expected %d undelivered messages, got %d", len(pending), len(left))
+	}
+	for _, done := range pending {
+		if err := <-done; err != context.DeadlineExceeded {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	}
+}
+
+func TestBackoffPolicies(t *testing.T) {
+	exp := &fq.ExponentialBackoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2, MaxAttempts: 5}
+	want := []time.Duration{10, 20, 40, 50}
+	var prev time.Duration
+	for i, w := range want {
+		d, ok := exp.Backoff(i+1, prev)
+		if !ok || d != w*time.Millisecond {
+			t.Errorf("exponential attempt %d: %v, %v", i+1, d, ok)
+		}
+		prev = d
+	}
+	if _, ok := exp.Backoff(5, prev); ok {
+		t.Errorf("exponential should give up after MaxAttempts")
+	}
+	dp := fq.DefaultBackoff()
+	dp.Max = 0
+	if d, _ := fq.DefaultBackoff().Backoff(1000, 0); d > time.Second+100*time.Millisecond {
+		t.Errorf("changing one default policy changed another: %v", d)
+	}
+
+	jit := &fq.ExponentialBackoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 1, Jitter: 0.5}
+	dj := &fq.DecorrelatedJitterBackoff{Base: 10 * time.Millisecond, Max: 100 * time.Millisecond}
+	prev = 0
+	for i := 1; i < 100; i++ {
+		if d, _ := jit.Backoff(i, 0); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("jitter out of range: %v", d)
+		}
+		d, ok := dj.Backoff(i, prev)
+		if !ok || d < dj.Base || d > dj.Max || (prev > 0 && d > 3*prev) {
+			t.Fatalf("decorrelated attempt %d: %v after %v", i, d, prev)
+		}
+		prev = d
+	}
+
+	// Fields left at zero must not make for a tight reconnect loop.
+	zero := []fq.BackoffPolicy{
+		&fq.ExponentialBackoff{Initial: time.Second, Multiplier: 2, MaxAttempts: 5},
+		&fq.ExponentialBackoff{Initial: time.Second, Max: time.Minute},
+		&fq.ExponentialBackoff{Jitter: 5},
+		&fq.ExponentialBackoff{},
+		&fq.DecorrelatedJitterBackoff{Base: time.Second},
+		&fq.DecorrelatedJitterBackoff{},
+	}
+	for i, p := range zero {
+		prev = 0
+		for attempt := 1; attempt < 4; attempt++ {
+			d, ok := p.Backoff(attempt, prev)
+			if !ok || d <= 0 {
+				t.Errorf("policy %d attempt %d: %v after %v, %v", i, attempt, d, prev, ok)
+			}
+			prev = d
+		}
+	}
+	if d, _ := zero[0].Backoff(4, 0); d != 8*time.Second {
+		t.Errorf("uncapped exponential: %v, expected 8s", d)
+	}
+	if d, _ := zero[1].Backoff(3, 0); d != 4*time.Second {
+		t.Errorf("default multiplier: %v, expected 4s", d)
+	}
+	if d, _ := zero[3].Backoff(1000, 0); d <= 0 {
+		t.Errorf("uncapped exponential overflowed: %v", d)
+	}
+	if d, _ := zero[4].Backoff(100, math.MaxInt64); d < time.Second {
+		t.Errorf("uncapped decorrelated: %v", d)
+	}
+
+	c := &fq.ConstantBackoff{Delay: time.Millisecond, MaxAttempts: 2}
+	if d, ok := c.Backoff(1, 0); !ok || d != time.Millisecond {
+		t.Errorf("constant: %v, %v", d, ok)
+	}
+	if _, ok := c.Backoff(2, time.Millisecond); ok {
+		t.Errorf("constant should give up after MaxAttempts")
+	}
+}
+
+type reconnectHooks struct {
+	countingHooks
+	attempts chan int
+}
+
+func (h *reconnectHooks) ReconnectHook(c *fq.Client, attempt int, delay time.Duration) {
+	h.attempts <- attempt
+}
+
+func TestBackoffGiveUp(t *testing.T) {
+	srv := fqtest.NewServer()
+	srv.Close()
+	hooks := &reconnectHooks{attempts: make(chan int, 10)}
+	fqclient := fq.NewClient()
+	fqclient.SetHooks(hooks)
+	fqclient.SetBackoff(&fq.ConstantBackoff{Delay: 10 * time.Millisecond, MaxAttempts: 3})
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.backoff", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); !errors.Is(err, fq.ErrGaveUp) {
+		t.Fatalf("expected ErrGaveUp, got %v", err)
+	}
+	close(hooks.attempts)
+	var attempts []int
+	for a := range hooks.attempts {
+		attempts = append(attempts, a)
+	}
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Errorf("unexpected reconnect attempts %v", attempts)
+	}
+	if fqclient.Publish(fq.NewMessage("logging", "test", nil)) {
+		t.Errorf("Publish after giving up should fail")
+	}
+	if left, _ := fqclient.Close(ctx); len(left) != 1 {
+		t.Errorf("expected the queued message back, got %d", len(left))
+	}
+}
+
+// waitFor polls cond until it holds or ctx is done.
+func waitFor(t *testing.T, ctx context.Context, what string, cond func() bool) {
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", what)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	dead := fqtest.NewServer()
+	dead.Close()
+	a, b := fqtest.NewServer(), fqtest.NewServer()
+	defer a.Close()
+	defer b.Close()
+
+	hooks := &countingHooks{}
+	fqclient := fq.NewClient()
+	fqclient.SetHooks(hooks)
+	fqclient.SetBackoff(&fq.ConstantBackoff{Delay: 10 * time.Millisecond})
+	fqclient.SetServerSelection(fq.HealthiestServer)
+	if err := fqclient.SetServers(dead.Addr(), a.Addr(), b.Addr()); err != nil {
+		t.Fatalf("SetServers: %v", err)
+	}
+	fqclient.Creds(dead.Host(), dead.Port(), "gotest", "nopass")
+	defer fqclient.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+	if fqclient.Server() != a.Addr() {
+		t.Errorf("connected to %s, expected %s", fqclient.Server(), a.Addr())
+	}
+
+	// a dies; b is the only server that has never failed
+	a.Close()
+	waitFor(t, ctx, "failover", func() bool { return hooks.auths.Load() == 2 })
+	if fqclient.Server() != b.Addr() {
+		t.Errorf("failed over to %s, expected %s", fqclient.Server(), b.Addr())
+	}
+
+	// b drops us, but it has still failed less than the others
+	b.DropConnections()
+	waitFor(t, ctx, "reconnect", func() bool { return hooks.auths.Load() == 3 })
+	if fqclient.Server() != b.Addr() {
+		t.Errorf("reconnected to %s, expected %s", fqclient.Server(), b.Addr())
+	}
+}
+
+func TestFailoverRotate(t *testing.T) {
+	a, b := fqtest.NewServer(), fqtest.NewServer()
+	defer a.Close()
+	defer b.Close()
+	hooks := &countingHooks{}
+	fqclient, err := fq.Dial(a.Addr(),
+		fq.WithCredentials("gotest", "nopass"),
+		fq.WithHooks(hooks),
+		fq.WithServers("localhost:"+strconv.Itoa(int(b.Port()))))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fqclient.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	waitFor(t, ctx, "connect", func() bool { return hooks.auths.Load() == 1 })
+	if fqclient.Server() != a.Addr() {
+		t.Errorf("connected to %s, expected %s", fqclient.Server(), a.Addr())
+	}
+	a.DropConnections()
+	waitFor(t, ctx, "failover", func() bool { return hooks.auths.Load() == 2 })
+	// localhost is resolved to one or more addresses, one of which b
+	// is listening on
+	if host, port, _ := net.SplitHostPort(fqclient.Server()); net.ParseIP(host) == nil || port != strconv.Itoa(int(b.Port())) {
+		t.Errorf("failed over to %s, expected an address of localhost:%d", fqclient.Server(), b.Port())
+	}
+}
+
+// roundTrip binds to rk on a connected client, then publishes a
+// message to it and waits for it to come back.
+func roundTrip(t *testing.T, ctx context.Context, c *fq.Client, rk string) {
+	t.Helper()
+	if _, err := c.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"` + rk + `"`,
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	c.Publish(fq.NewMessage("logging", rk, []byte(rk)))
+	done := make(chan *fq.Message, 1)
+	go func() { done <- c.Receive(true) }()
+	select {
+	case msg := <-done:
+		if !bytes.Equal(msg.Payload, []byte(rk)) {
+			t.Errorf("unexpected message %s", msg.Payload)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Message recv timed out")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	srv := fqtest.NewUnstartedServer()
+	sni := make(chan string, 2)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	fqclient := fq.NewClient()
+	fqclient.SetTLSConfig(srv.ClientConfig())
+	fqclient.Creds("localhost", srv.Port(), "gotest", "nopass")
+	defer fqclient.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+	roundTrip(t, ctx, fqclient, "test.gotest.tls")
+	// both the command and data connections
+	for i := 0; i < 2; i++ {
+		if name := <-sni; name != "localhost" {
+			t.Errorf("server name %q, expected localhost", name)
+		}
+	}
+}
+
+func TestTLSRejected(t *testing.T) {
+	srv := fqtest.NewUnstartedServer()
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	nocert := srv.ClientConfig()
+	nocert.Certificates = nil
+	for name, config := range map[string]*tls.Config{
+		"plain":          nil,
+		"no client cert": nocert,
+		"untrusted":      &tls.Config{},
+	} {
+		fqclient := fq.NewClient()
+		fqclient.SetTLSConfig(config)
+		fqclient.SetBackoff(&fq.ConstantBackoff{MaxAttempts: 1})
+		fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		// with TLS 1.3 a missing client certificate is only noticed
+		// once the client reads, so that fails authentication
+		if err := fqclient.ConnectContext(ctx); err == nil {
+			t.Errorf("%s: connected", name)
+		}
+		cancel()
+		fqclient.Shutdown()
+	}
+}
+
+func TestDialer(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	unix := fqtest.NewUnstartedServer()
+	unix.Listener.Close()
+	path := filepath.Join(t.TempDir(), "fq.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	unix.Listener = l
+	unix.Start()
+	defer unix.Close()
+
+	var dials atomic.Int32
+	counted := fq.DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return srv.DialContext(ctx, network, addr)
+	})
+	dialers := []struct {
+		name   string
+		dialer fq.Dialer
+	}{
+		{"pipe", counted},
+		{"unix", fq.UnixDialer(path)},
+		// only Dial, not DialContext
+		{"plain", struct{ fq.Dialer }{&net.Dialer{}}},
+	}
+	for _, d := range dialers {
+		fqclient := fq.NewClient()
+		fqclient.SetDialer(d.dialer)
+		if d.name == "plain" {
+			fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+		} else {
+			// never resolved or dialed directly
+			fqclient.Creds("fq.invalid", 8765, "gotest", "nopass")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := fqclient.ConnectContext(ctx); err != nil {
+			t.Fatalf("%s: ConnectContext: %v", d.name, err)
+		}
+		roundTrip(t, ctx, fqclient, "test.gotest."+d.name)
+		cancel()
+		fqclient.Shutdown()
+	}
+	// the command and data connections
+	if n := dials.Load(); n != 2 {
+		t.Errorf("%d pipe dials, expected 2", n)
+	}
+}
+
+// writeCounter is a Dialer counting the writes made on the
+// connections it dials.
+type writeCounter struct {
+	writes atomic.Int64
+}
+
+type countedConn struct {
+	net.Conn
+	w *writeCounter
+}
+
+func (c countedConn) Write(p []byte) (int, error) {
+	c.w.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+func (w *writeCounter) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return countedConn{conn, w}, nil
+}
+
+func TestBatching(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	const n = 100
+	for _, tc := range []struct {
+		name       string
+		max        int
+		linger     time.Duration
+		minW, maxW int64
+	}{
+		{"per message", 1, 0, n, 2 * n},
+		{"lingering", fq.DefaultBatchSize, 50 * time.Millisecond, 1, 10},
+	} {
+		counter := &writeCounter{}
+		fqclient := fq.NewClient()
+		fqclient.SetDialer(counter)
+		fqclient.SetBatching(tc.max, tc.linger)
+		fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := fqclient.ConnectContext(ctx); err != nil {
+			t.Fatalf("%s: ConnectContext: %v", tc.name, err)
+		}
+		rk := "test.gotest.batch." + strings.ReplaceAll(tc.name, " ", "_")
+		if _, err := fqclient.BindContext(ctx, &fq.BindReq{
+			Exchange: fq.Rk("logging"),
+			Flags:    fq.FQ_BIND_TRANS,
+			Program:  `exact:"` + rk + `"`,
+		}); err != nil {
+			t.Fatalf("%s: BindContext: %v", tc.name, err)
+		}
+
+		before := counter.writes.Load()
+		var confirms []<-chan error
+		for i := 0; i < n; i++ {
+			confirms = append(confirms, fqclient.PublishAsync(fq.NewMessage("logging", rk, []byte(strconv.Itoa(i)))))
+		}
+		for _, confirm := range confirms {
+			select {
+			case err := <-confirm:
+				if err != nil {
+					t.Fatalf("%s: PublishAsync: %v", tc.name, err)
+				}
+			case <-ctx.Done():
+				t.Fatalf("%s: PublishAsync not confirmed", tc.name)
+			}
+		}
+		if w := counter.writes.Load() - before; w < tc.minW || w > tc.maxW {
+			t.Errorf("%s: %d writes for %d messages, expected %d-%d", tc.name, w, n, tc.minW, tc.maxW)
+		}
+
+		received := make(chan []byte, n)
+		go func() {
+			for i := 0; i < n; i++ {
+				received <- fqclient.Receive(true).Payload
+			}
+		}()
+		for i := 0; i < n; i++ {
+			select {
+			case payload := <-received:
+				if string(payload) != strconv.Itoa(i) {
+					t.Fatalf("%s: message %d has payload %s", tc.name, i, payload)
+				}
+			case <-ctx.Done():
+				t.Fatalf("%s: message %d not received", tc.name, i)
+			}
+		}
+		cancel()
+		fqclient.Shutdown()
+	}
+}
+
+func TestRelease(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient := fq.NewClient()
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	defer fqclient.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+	if _, err := fqclient.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.release"`,
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+
+	// Released messages are reused for those that follow, which must
+	// not see their contents.
+	const n = 50
+	for i := 0; i < n; i++ {
+		msg := fq.NewMessage("logging", "test.gotest.release", bytes.Repeat([]byte{'a' + byte(i%26)}, n-i))
+		fqclient.Publish(msg)
+		msg.Release() // no effect on our own messages
+	}
+	received := make(chan string, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			msg := fqclient.Receive(true)
+			received <- string(msg.Payload)
+			msg.Release()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		select {
+		case payload := <-received:
+			if want := strings.Repeat(string(rune('a'+i%26)), n-i); payload != want {
+				t.Fatalf("message %d: payload %q, want %q", i, payload, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message %d not received", i)
+		}
+	}
+}
+
+func TestReceiveLimits(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient := fq.NewClient()
+	fqclient.SetReceiveLimits(16, 0)
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	defer fqclient.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+	if _, err := fqclient.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.limits"`,
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.limits", bytes.Repeat([]byte("x"), 17)))
+	var le *wire.LimitError
+	waitFor(t, ctx, "limit error", func() bool {
+		return errors.As(fqclient.LastError(), &le)
+	})
+	if le.What != "payload" || le.Size != 17 || le.Limit != 16 {
+		t.Errorf("unexpected limit error %v", le)
+	}
+
+	// the data connection is reestablished and carries on
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.limits", []byte("fits")))
+	received := make(chan *fq.Message, 1)
+	go func() { received <- fqclient.Receive(true) }()
+	select {
+	case msg := <-received:
+		if string(msg.Payload) != "fits" {
+			t.Errorf("unexpected payload %q", msg.Payload)
+		}
+	case <-ctx.Done():
+		t.Fatalf("message not received")
+	}
+}
+
+func TestPublishLimits(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	fqclient := fq.NewClient()
+	fqclient.SetPublishLimits(8, 20, 24)
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	defer fqclient.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := fqclient.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+
+	long := strings.Repeat("x", fq.FQ_MAX_RK_LEN+1)
+	tests := []struct {
+		msg         *fq.Message
+		what        string
+		size, limit int
+	}{
+		{fq.NewMessage("logging", "test.gotest", []byte("too long!")), "payload", 9, 8},
+		{fq.NewMessage("logging", "test.gotest.too.long", nil), "route", 20, 20},
+		{fq.NewMessage("logging", "test.gotest.far.too.long", nil), "route", 24, 20},
+		{fq.NewMessage(long, "test.gotest", nil), "exchange", len(long), fq.FQ_MAX_RK_LEN},
+		{fq.NewMessage("logging", long, nil), "route", len(long), fq.FQ_MAX_RK_LEN},
+	}
+	for _, tt := range tests {
+		var le *fq.LimitError
+		select {
+		case err := <-fqclient.PublishAsync(tt.msg):
+			if tt.size == tt.limit {
+				if err != nil {
+					t.Errorf("%s of %d: %v", tt.what, tt.size, err)
+				}
+				continue
+			}
+			if !errors.As(err, &le) || le.What != tt.what || le.Size != tt.size || le.Limit != tt.limit {
+				t.Errorf("%s of %d: expected a LimitError, got %v", tt.what, tt.size, err)
+			}
+		default:
+			if tt.size != tt.limit {
+				t.Errorf("%s of %d: not refused synchronously", tt.what, tt.size)
+			}
+		}
+	}
+	if fqclient.Publish(tests[0].msg) {
+		t.Errorf("Publish accepted an oversized payload")
+	}
+	var le *fq.LimitError
+	if !errors.As(fqclient.LastError(), &le) || le.What != "payload" {
+		t.Errorf("expected a LimitError, got %v", fqclient.LastError())
+	}
+	if err := fqclient.TryPublish(tests[3].msg); !errors.As(err, &le) || le.What != "exchange" {
+		t.Errorf("TryPublish: expected a LimitError, got %v", err)
+	}
+	if err := fqclient.TryPublish(tests[1].msg); err != nil {
+		t.Errorf("TryPublish: %v", err)
+	}
+
+	_, err := fqclient.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `prefix:"test.gotest.limits"`,
+	})
+	if !errors.As(err, &le) || le.What != "program" {
+		t.Errorf("expected a LimitError, got %v", err)
+	}
+	if _, err := fq.NewRk(long); !errors.As(err, &le) || le.What != "name" {
+		t.Errorf("expected a LimitError, got %v", err)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	opts := fq.SpoolOptions{SegmentSize: 1024, Sync: fq.SyncAlways}
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Published while the server is unreachable, and left spooled
+	dead := fqtest.NewServer()
+	dead.Close()
+	pub := fq.NewClient()
+	if err := pub.SetSpool(dir, opts); err != nil {
+		t.Fatalf("SetSpool: %v", err)
+	}
+	pub.Creds(dead.Host(), dead.Port(), "gotest", "nopass")
+	pub.Connect()
+	const n = 100
+	for i := 0; i < n; i++ {
+		msg := fq.NewMessage("logging", "test.gotest.spool", []byte(strconv.Itoa(i)))
+		if err := <-pub.PublishAsync(msg); err != nil {
+			t.Fatalf("PublishAsync: %v", err)
+		}
+	}
+	if backlog := pub.DataBacklog(); backlog != n {
+		t.Errorf("backlog %d, want %d", backlog, n)
+	}
+	closeCtx, closeCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	left, err := pub.Close(closeCtx)
+	closeCancel()
+	if len(left) != 0 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close returned %d messages, %v", len(left), err)
+	}
+
+	sub := fq.NewClient()
+	sub.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	defer sub.Shutdown()
+	if err := sub.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+	if _, err := sub.BindContext(ctx, &fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  `exact:"test.gotest.spool"`,
+	}); err != nil {
+		t.Fatalf("BindContext: %v", err)
+	}
+
+	// A new Client sends what the last one could not
+	pub = fq.NewClient()
+	if err := pub.SetSpool(dir, opts); err != nil {
+		t.Fatalf("SetSpool: %v", err)
+	}
+	pub.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	if err := pub.ConnectContext(ctx); err != nil {
+		t.Fatalf("ConnectContext: %v", err)
+	}
+	received := make(chan string, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			received <- string(sub.Receive(true).Payload)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		select {
+		case payload := <-received:
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("message %d: payload %q", i, payload)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message %d not received", i)
+		}
+	}
+	waitFor(t, ctx, "empty backlog", func() bool { return pub.DataBacklog() == 0 })
+	pub.Shutdown()
+	// only the segment last written to is left
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*.seg")); len(segs) != 1 {
+		t.Errorf("segments left: %v", segs)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	dead := fqtest.NewServer()
+	dead.Close()
+	pub, err := fq.Dial(dead.Addr(),
+		fq.WithCredentials("gotest", "nopass"),
+		fq.WithSpool(t.TempDir(), fq.SpoolOptions{SegmentSize: 512, MaxSize: 1024, Sync: fq.SyncNever}))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	payload := bytes.Repeat([]byte("x"), 100)
+	for i := 0; ; i++ {
+		err := <-pub.PublishAsync(fq.NewMessage("logging", "test.gotest.full", payload))
+		if errors.Is(err, fq.ErrSpoolFull) {
+			if i < 5 {
+				t.Errorf("spool full after %d messages", i)
+			}
+			break
+		}
+		if err != nil || i > 10 {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pub.Close(ctx)
+}
+
+func BenchmarkPublish(b *testing.B) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	payload := bytes.Repeat([]byte("x"), 100)
+	for _, bc := range []struct {
+		name   string
+		max    int
+		linger time.Duration
+	}{
+		{"per message", 1, 0},
+		{"batched", fq.DefaultBatchSize, 0},
+		{"linger 1ms", fq.DefaultBatchSize, time.Millisecond},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			fqclient := fq.NewClient()
+			fqclient.SetBatching(bc.max, bc.linger)
+			fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+			if err := fqclient.ConnectContext(context.Background()); err != nil {
+				b.Fatalf("ConnectContext: %v", err)
+			}
+			defer fqclient.Shutdown()
+			msg := fq.NewMessage("logging", "test.gotest.bench", payload)
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			var last <-chan error
+			for i := 0; i < b.N; i++ {
+				last = fqclient.PublishAsync(msg)
+			}
+			if err := <-last; err != nil {
+				b.Fatalf("PublishAsync: %v", err)
+			}
+		})
+	}
+}
+
+func TestProtocolViolationError(t *testing.T) {
+	err := fmt.Errorf("auth:proto: %w", &fq.ProtocolViolationError{Command: 0xbeef, Expected: "auth response"})
+	var pve *fq.ProtocolViolationError
+	if !errors.As(err, &pve) {
+		t.Fatalf("errors.As failed on %v", err)
+	}
+	if pve.Command != 0xbeef {
+		t.Errorf("unexpected command 0x%04x", pve.Command)
+	}
+	if err.Error() != "auth:proto: protocol violation: 0xbeef (exp auth response)" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
+
+func TestDial(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	tsh := fq.NewTSHooks()
+	tsh.AddBinding("logging", "prefix:\"test.gotest.dial\"")
+	fqclient, err := fq.Dial(srv.Addr(),
+		fq.WithCredentials("gotest", "nopass"),
+		fq.WithQueue("gotest-dial", "mem"),
+		fq.WithBacklog(10),
+		fq.WithHeartBeat(250*time.Millisecond),
+		fq.WithHeartBeatMaxAge(time.Second),
+		fq.WithDialTimeout(time.Second),
+		fq.WithHooks(&tsh))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	time.Sleep(250 * time.Millisecond)
+	msg := fq.NewMessage("logging", "test.gotest.dial", []byte("DIAL"))
+	fqclient.Publish(msg)
+	select {
+	case nmsg := <-tsh.MsgsC:
+		if !bytes.Equal(nmsg.Payload, msg.Payload) {
+			t.Errorf("payload corrupted")
+		}
+	case err := <-tsh.ErrorsC:
+		t.Errorf("Error: %v", err)
+	case <-time.NewTimer(2 * time.Second).C:
+		t.Errorf("timeout")
+	}
+}
+
+func TestDialInvalid(t *testing.T) {
+	creds := fq.WithCredentials("gotest", "nopass")
+	tsh := fq.NewTSHooks()
+	cases := []struct {
+		name string
+		addr string
+		opts []fq.Option
+	}{
+		{"no creds", "localhost:8765", nil},
+		{"empty user", "localhost:8765", []fq.Option{fq.WithCredentials("", "x")}},
+		{"bad port", "localhost:none", []fq.Option{creds}},
+		{"no host", ":8765", []fq.Option{creds}},
+		{"zero backlog", "localhost", []fq.Option{creds, fq.WithBacklog(0)}},
+		{"long heartbeat", "localhost", []fq.Option{creds, fq.WithHeartBeat(2 * time.Second)}},
+		{"short max age", "localhost", []fq.Option{creds,
+			fq.WithHeartBeat(500 * time.Millisecond), fq.WithHeartBeatMaxAge(100 * time.Millisecond)}},
+		{"zero dial timeout", "localhost", []fq.Option{creds, fq.WithDialTimeout(0)}},
+		{"nil hooks", "localhost", []fq.Option{creds, fq.WithHooks(nil)}},
+		{"sync without hooks", "localhost", []fq.Option{creds, fq.WithSynchronous()}},
+		{"empty queue", "localhost", []fq.Option{creds, fq.WithQueue("", "mem")}},
+		{"nil tls config", "localhost", []fq.Option{creds, fq.WithTLS(nil)}},
+		{"nil dialer", "localhost", []fq.Option{creds, fq.WithDialer(nil)}},
+		{"zero cooldown", "localhost", []fq.Option{creds, fq.WithFailoverCooldown(0)}},
+		{"zero resolve interval", "localhost", []fq.Option{creds, fq.WithResolveInterval(0)}},
+		{"negative limits", "localhost", []fq.Option{creds, fq.WithReceiveLimits(-1, 0)}},
+		{"negative publish limits", "localhost", []fq.Option{creds, fq.WithPublishLimits(0, -1, 0)}},
+		{"no spool dir", "localhost", []fq.Option{creds, fq.WithSpool("", fq.SpoolOptions{})}},
+		{"spill without func", "localhost", []fq.Option{creds,
+			fq.WithOverflowPolicy(fq.OverflowPolicy{Action: fq.OverflowSpill})}},
+		{"receive sampling", "localhost", []fq.Option{creds,
+			fq.WithReceivePolicy(fq.ReceivePolicy{Action: fq.OverflowSample})}},
+		{"zero port", "localhost:0", []fq.Option{creds, fq.WithHooks(&tsh), fq.WithSynchronous()}},
+	}
+	for _, tc := range cases {
+		if c, err := fq.Dial(tc.addr, tc.opts...); err == nil || c != nil {
+			t.Errorf("%s: expected error, got %v, %v", tc.name, c, err)
+		}
+	}
+}
+
+// syncHooks records events without locking; under -race any hook
+// delivered outside of Receive is reported.
+type syncHooks struct {
+	events []string
+	routes []uint32
+	stats  map[string]uint32
+}
+
+func (h *syncHooks) AuthHook(c *fq.Client, err error) {
+	if err != nil {
+		h.events = append(h.events, "autherr")
+		return
+	}
+	h.events = append(h.events, "auth")
+	c.Bind(&fq.BindReq{
+		Exchange: fq.Rk("logging"),
+		Flags:    fq.FQ_BIND_TRANS,
+		Program:  "prefix:\"test.gotest.sync\"",
+	})
+}
+func (h *syncHooks) BindHook(c *fq.Client, breq *fq.BindReq) {
+	h.events = append(h.events, "bind")
+	h.routes = append(h.routes, breq.OutRouteId)
+}
+func (h *syncHooks) UnbindHook(c *fq.Client, breq *fq.UnbindReq) {
+	h.events = append(h.events, "unbind")
+}
+func (h *syncHooks) DisconnectHook(c *fq.Client) {
+	h.events = append(h.events, "disconnect")
+}
+func (h *syncHooks) StatusHook(c *fq.Client, stats map[string]uint32) {
+	h.events = append(h.events, "status")
+	h.stats = stats
+}
+func (h *syncHooks) ErrorLogHook(c *fq.Client, err string) {
+}
+func (h *syncHooks) MessageHook(c *fq.Client, msg *fq.Message) bool {
+	return false
+}
+
+// pump drives Receive until cond holds, collecting any messages seen.
+func pump(t *testing.T, c *fq.Client, msgs *[]*fq.Message, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		if msg := c.Receive(false); msg != nil {
+			*msgs = append(*msgs, msg)
+		} else {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func count(events []string, ev string) int {
+	n := 0
+	for _, e := range events {
+		if e == ev {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSynchronous(t *testing.T) {
+	srv := fqtest.NewServer()
+	defer srv.Close()
+	hooks := &syncHooks{}
+	fqclient := fq.NewClient()
+	fqclient.SetHooks(hooks)
+	// The hooks rebind from AuthHook themselves.
+	fqclient.SetRebind(false)
+	fqclient.SetSynchronous(true)
+	fqclient.SetHeartBeat(100 * time.Millisecond)
+	fqclient.Creds(srv.Host(), srv.Port(), "gotest", "nopass")
+	fqclient.Connect()
+
+	var msgs []*fq.Message
+	pump(t, fqclient, &msgs, "first bind", func() bool { return count(hooks.events, "bind") == 1 })
+
+	// Reconnect a few times; each must deliver disconnect, auth and
+	// the rebind from AuthHook, in that order.
+	for i := 1; i <= 3; i++ {
+		srv.DropConnections()
+		pump(t, fqclient, &msgs, "rebind", func() bool { return count(hooks.events, "bind") == i+1 })
+	}
+
+	fqclient.Publish(fq.NewMessage("logging", "test.gotest.sync", []byte("SYNC")))
+	pump(t, fqclient, &msgs, "message", func() bool { return len(msgs) == 1 })
+	if !bytes.Equal(msgs[0].Payload, []byte("SYNC")) {
+		t.Errorf("payload corrupted")
+	}
+
+	fqclient.Status()
+	pump(t, fqclient, &msgs, "status", func() bool { return hooks.stats != nil })
+	if hooks.stats["routed"] == 0 {
+		t.Errorf("expected routed messages in %v", hooks.stats)
+	}
+
+	route := hooks.routes[len(hooks.routes)-1]
+	fqclient.Unbind(&fq.UnbindReq{Exchange: fq.Rk("logging"), RouteId: route})
+	pump(t, fqclient, &msgs, "unbind", func() bool { return count(hooks.events, "unbind") == 1 })
+
+	expected := []string{"auth", "bind"}
+	for i := 0; i < 3; i++ {
+		expected = append(expected, "disconnect", "auth", "bind")
+	}
+	expected = append(expected, "status", "unbind")
+	if len(hooks.events) != len(expected) {
+		t.Fatalf("events %v, expected %v", hooks.events, expected)
+	}
+	for i := range expected {
+		if hooks.events[i] != expected[i] {
+			t.Fatalf("events %v, expected %v", hooks.events, expected)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// BackoffPolicy decides how long the Client waits between failed
+// attempts to (re)connect.
+//
+// Backoff is called after the attempt'th consecutive failure (counting
+// from 1) with the delay it returned for the previous failure (0 for
+// the first).  It returns the delay before the next attempt, or false
+// to give up.  Once a connection has been established the count starts
+// over, and the first reconnect after a disconnect is immediate.
+//
+// Backoff is only called from a single goroutine, but a policy shared
+// between Clients must be safe for concurrent use.  The policies here
+// are.
+type BackoffPolicy interface {
+	Backoff(attempt int, prev time.Duration) (time.Duration, bool)
+}
+
+// ReconnectHooks may be implemented by Hooks to be told of each
+// failed connection attempt.  attempt counts consecutive failures and
+// delay is how long the Client will wait before trying again.  The
+// cause is available from LastError.  Like the error hooks, it is
+// always called from the Client's go routines.
+type ReconnectHooks interface {
+	ReconnectHook(c *Client, attempt int, delay time.Duration)
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier after every
+// failure, starting at Initial and capped at Max.  Each delay is then
+// varied randomly by up to Jitter (a fraction, 0.1 being ±10%).
+// Fields left at zero default sensibly: Initial to 16ms, Multiplier
+// (or one below 1) to 2 and Max to no cap.  Jitter is kept below 1.
+type ExponentialBackoff struct {
+	Initial, Max time.Duration
+	Multiplier   float64
+	Jitter       float64
+	// MaxAttempts gives up after that many consecutive failures.
+	// Zero retries forever.
+	MaxAttempts int
+}
+
+func (b *ExponentialBackoff) Backoff(attempt int, prev time.Duration) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+	initial, limit, mult := or_backoff(b.Initial), max_backoff(b.Max), b.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+	d := float64(initial)
+	for i := 1; i < attempt && d < float64(limit); i++ {
+		d *= mult
+	}
+	if d > float64(limit) {
+		d = float64(limit)
+	}
+	if jitter := min(b.Jitter, max_jitter); jitter > 0 {
+		rngM.Lock()
+		d += d * jitter * (2*rng.Float64() - 1)
+		rngM.Unlock()
+	}
+	// Without a Max, d can grow beyond what a Duration holds.
+	if d >= float64(math.MaxInt64) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(d), true
+}
+
+const (
+	// default_backoff is the first delay of policies without one.
+	default_backoff = 16 * time.Millisecond
+	// max_jitter keeps jittered delays from shrinking to nothing.
+	max_jitter = 0.99
+)
+
+func or_backoff(d time.Duration) time.Duration {
+	if d <= 0 {
+		return default_backoff
+	}
+	return d
+}
+
+// max_backoff is the cap on delays, unlimited if unset.
+func max_backoff(d time.Duration) time.Duration {
+	if d <= 0 {
+		return math.MaxInt64
+	}
+	return d
+}
+
+// DecorrelatedJitterBackoff picks each delay at random between Base
+// and three times the previous delay, capped at Max.  It spreads out
+// the reconnects of many clients better than ExponentialBackoff.  A
+// zero Base defaults to 16ms and a zero Max to no cap.
+type DecorrelatedJitterBackoff struct {
+	Base, Max time.Duration
+	// MaxAttempts gives up after that many consecutive failures.
+	// Zero retries forever.
+	MaxAttempts int
+}
+
+func (b *DecorrelatedJitterBackoff) Backoff(attempt int, prev time.Duration) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+	base, limit := or_backoff(b.Base), max_backoff(b.Max)
+	if base > limit {
+		base = limit
+	}
+	prev = min(max(prev, base), limit)
+	d := base
+	span := time.Duration(math.MaxInt64) - base
+	if prev <= span/3 {
+		span = 3*prev - base
+	}
+	if span > 0 {
+		rngM.Lock()
+		d += time.Duration(rng.Int63n(int64(span)))
+		rngM.Unlock()
+	}
+	return min(d, limit), true
+}
+
+// ConstantBackoff always waits Delay.
+type ConstantBackoff struct {
+	Delay time.Duration
+	// MaxAttempts gives up after that many consecutive failures.
+	// Zero retries forever.
+	MaxAttempts int
+}
+
+func (b *ConstantBackoff) Backoff(attempt int, prev time.Duration) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+	return b.Delay, true
+}
+
+// DefaultBackoff returns the policy used by Clients without a
+// BackoffPolicy of their own: starting at 16ms and growing by 1/16th
+// per failure to 1s.  Each call returns a new policy, which may be
+// adjusted and passed to SetBackoff.
+func DefaultBackoff() *ExponentialBackoff {
+	return &ExponentialBackoff{
+		Initial:    16 * time.Millisecond,
+		Max:        time.Second,
+		Multiplier: 1.0625,
+		Jitter:     0.1,
+	}
+}
+
+var default_policy BackoffPolicy = DefaultBackoff()
+
+// SetBackoff sets the policy pacing reconnection attempts.  A nil
+// policy selects DefaultBackoff.
+func (c *Client) SetBackoff(policy BackoffPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backoff = policy
+}
+
+// SetDialTimeout sets the timeout for establishing each connection
+// to the server.  The default is two seconds.
+func (c *Client) SetDialTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dial_timeout = timeout
+}
+
+// next_backoff consults the policy after a failed attempt, reporting
+// the attempt to the hooks, or gives up and stops the Client.
+func (c *Client) next_backoff(attempt int, prev time.Duration) (time.Duration, bool) {
+	c.mu.Lock()
+	policy, hooks := c.backoff, c.hooks
+	c.mu.Unlock()
+	if policy == nil {
+		policy = default_policy
+	}
+	delay, ok := policy.Backoff(attempt, prev)
+	if !ok {
+		err := fmt.Errorf("%w after %d attempts", ErrGaveUp, attempt)
+		if last := c.LastError(); last != nil {
+			err = fmt.Errorf("%w after %d attempts: %v", ErrGaveUp, attempt, last)
+		}
+		c.error(err)
+		c.notify_auth(err)
+		c.halt()
+		return 0, false
+	}
+	if rh, ok := hooks.(ReconnectHooks); ok {
+		rh.ReconnectHook(c, attempt, delay)
+	}
+	return delay, true
+}
@@ -0,0 +1,144 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"net"
+	"time"
+)
+
+// DefaultBatchSize is the number of bytes of messages the Client
+// collects before writing them to the server, unless SetBatching says
+// otherwise.
+const DefaultBatchSize = 64 * 1024
+
+// SetBatching controls how published messages are written.  The
+// Client serializes queued messages into a buffer and writes it with
+// a single call once it holds maxBytes (a single larger message is
+// written on its own), or once no more messages are queued.  With a
+// positive linger, it instead waits up to linger for more messages
+// before writing a batch that is not full, trading latency for fewer,
+// larger writes.  maxBytes of 1 writes every message separately.  A
+// message is confirmed (see PublishAsync) once its batch has been
+// written; if that fails the whole batch is sent again on the next
+// connection.  Changes take effect on the next data connection.
+func (c *Client) SetBatching(maxBytes int, linger time.Duration) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultBatchSize
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batch_size = maxBytes
+	c.batch_linger = linger
+}
+
+// batch holds serialized messages awaiting a write, and the messages
+// to confirm once it has been written.
+type batch struct {
+	max     int
+	linger  time.Duration
+	buf     []byte
+	pending []*frontMessage
+}
+
+// add serializes m into b.  A message that cannot be encoded is
+// confirmed with the error instead.
+func (b *batch) add(m *frontMessage, peermode bool) error {
+	buf, err := fq_append_msg(b.buf, m.msg, peermode)
+	if err != nil {
+		m.confirm(err)
+		return err
+	}
+	b.buf = buf
+	b.pending = append(b.pending, m)
+	return nil
+}
+
+// send adds m to b along with whatever else is queued, waiting up to
+// the linger time for more, and writes the batch.  Only the data
+// sender may call it.
+func (c *Client) send(conn net.Conn, b *batch, m *frontMessage, sess *session) bool {
+	c.add(b, m)
+	var lingered <-chan time.Time
+	if b.linger > 0 {
+		t := time.NewTimer(b.linger)
+		defer t.Stop()
+		lingered = t.C
+	}
+fill:
+	for len(b.buf) < b.max {
+		if lingered == nil {
+			select {
+			case m := <-c.q:
+				c.add(b, m)
+				continue
+			default:
+				break fill
+			}
+		}
+		select {
+		case m := <-c.q:
+			c.add(b, m)
+		case <-lingered:
+			break fill
+		case <-c.closing:
+			break fill
+		case <-sess.done:
+			break fill
+		}
+	}
+	return c.flush(conn, b)
+}
+
+func (c *Client) add(b *batch, m *frontMessage) {
+	if err := b.add(m, c.peermode); err != nil {
+		c.error(err)
+	}
+}
+
+// flush writes b to conn and confirms its messages.  If that fails,
+// they are held in c.resend for the next data connection.  Only the
+// data sender may call it.
+func (c *Client) flush(conn net.Conn, b *batch) bool {
+	if len(b.pending) == 0 {
+		return true
+	}
+	if _, err := conn.Write(b.buf); err != nil {
+		c.resend = b.pending
+		b.buf, b.pending = nil, nil
+		return false
+	}
+	for i, m := range b.pending {
+		m.confirm(nil)
+		b.pending[i] = nil
+	}
+	b.pending = b.pending[:0]
+	if cap(b.buf) > 4*max(b.max, DefaultBatchSize) {
+		// don't hang on to the memory of an outsized message
+		b.buf = nil
+	} else {
+		b.buf = b.buf[:0]
+	}
+	return true
+}
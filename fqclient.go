@@ -25,15 +25,20 @@ package fq
  */
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/postwait/gofq/wire"
 	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -53,18 +58,9 @@ func getNativeEndian() binary.ByteOrder {
 }
 
 var ne = getNativeEndian()
-var be = binary.BigEndian
 var rng = rand.New(rand.NewSource(time.Now().Unix() * int64(os.Getpid())))
 var rngM sync.Mutex
 
-type peeringMode uint32
-
-const (
-	fq_PROTO_CMD_MODE      = peeringMode(0xcc50cafe)
-	fq_PROTO_DATA_MODE     = peeringMode(0xcc50face)
-	fq_PROTO_PEER_MODE     = peeringMode(0xcc50feed)
-	fq_PROTO_OLD_PEER_MODE = peeringMode(0xcc50fade)
-)
 const (
 	FQ_DEFAULT_QUEUE_TYPE = "mem"
 
@@ -74,41 +70,53 @@ const (
 	FQ_BIND_ILLEGAL = uint32(0xffffffff)
 
 	FQ_MAX_RK_LEN = 127
+
+	FQ_DEFAULT_PORT = 8765
 )
 
+// protoCommand identifies the kind of a command queued for the
+// command connection, by the request's code on the wire.
 type protoCommand uint16
 
 const (
-	fq_PROTO_ERROR      = protoCommand(0xeeee)
-	fq_PROTO_AUTH_CMD   = protoCommand(0xaaaa)
-	fq_PROTO_AUTH_PLAIN = protoCommand(0)
-	fq_PROTO_AUTH_RESP  = protoCommand(0xaa00)
-	fq_PROTO_HBREQ      = protoCommand(0x4848)
-	fq_PROTO_HB         = protoCommand(0xbea7)
-	fq_PROTO_BINDREQ    = protoCommand(0xb170)
-	fq_PROTO_BIND       = protoCommand(0xb171)
-	fq_PROTO_UNBINDREQ  = protoCommand(0x071b)
-	fq_PROTO_UNBIND     = protoCommand(0x171b)
-	fq_PROTO_STATUS     = protoCommand(0x57a7)
-	fq_PROTO_STATUSREQ  = protoCommand(0xc7a7)
-
-	fq_MAX_HOPS = 32
+	fq_PROTO_AUTH_CMD  = protoCommand(wire.CmdAuth)
+	fq_PROTO_HBREQ     = protoCommand(wire.CmdHeartbeatReq)
+	fq_PROTO_BINDREQ   = protoCommand(wire.CmdBindReq)
+	fq_PROTO_UNBINDREQ = protoCommand(wire.CmdUnbindReq)
+	fq_PROTO_STATUSREQ = protoCommand(wire.CmdStatusReq)
 )
 
 type hookType int
 
 const (
-	fq_AUTH_HOOK_TYPE = hookType(iota)
-	fq_CMD_HOOK_TYPE  = hookType(iota)
+	fq_AUTH_HOOK_TYPE       = hookType(iota)
+	fq_CMD_HOOK_TYPE        = hookType(iota)
+	fq_DISCONNECT_HOOK_TYPE = hookType(iota)
 )
 
+// RouteProgram is a compiled routing program, such as a
+// *route.Program.
+type RouteProgram interface {
+	String() string
+}
+
+// BindReq requests that messages on Exchange be routed to our queue
+// by Program.  If Route is set, it replaces Program when the request
+// is made.
 type BindReq struct {
 	Exchange   fq_rk
 	Flags      uint16
 	Program    string
+	Route      RouteProgram
 	OutRouteId uint32
 }
 
+func (req *BindReq) compile() {
+	if req.Route != nil {
+		req.Program = req.Route.String()
+	}
+}
+
 type UnbindReq struct {
 	Exchange   fq_rk
 	RouteId    uint32
@@ -130,22 +138,33 @@ type Message struct {
 	Sender_msgid            fq_msgid
 	Arrival_time            uint64
 	Payload                 []byte
+	pooled                  bool
+	// truncated records a name NewMessage had to shorten, so that
+	// Publish can refuse the message.
+	truncated error
 }
 
 // Hooks is the interface one implements to drive an fq session.
 //
 // If the Client has been set to synchronous mode via SetSynchronous
-// the hooks are invoked causally from invocations of Receive.
+// the AuthHook, BindHook, UnbindHook, StatusHook and DisconnectHook
+// are invoked causally, in order, from invocations of Receive.
 // Otherwise hooks are called as response to commands arrive or
-// actions happen (in another go routine).
+// actions happen (in another go routine).  MessageHook and the
+// error hooks are always called from the Client's go routines.
 //
 // AuthHook is called upon response to an authentication attempt
 // caused by Connect (and any subsequent automatic reconnections).
-// If err is nil, authentication was successful.
+// If err is nil, authentication was successful.  Transient bindings
+// are lost with the connection; the Client replays them itself unless
+// rebinding is disabled, in which case AuthHook may reissue them (see
+// SetRebind).
 //
 // BindHook is called upon response to a Bind request.  The same
 // BindReq passed to Bind will be presented here and OutRouteId
 // will be set.  If OutRouteId is FQ_BIND_ILLEGAL, the bind failed.
+// It is also called for replayed bindings unless RebindHooks is
+// implemented.
 //
 // UnbindHook is called upon response to an Unbind request. The
 // OutSuccess indicates whether the request was handled successfully.
@@ -162,7 +181,8 @@ type Message struct {
 // ErrorLogHook is invoked when the client encouters any sort of error.
 // All typicaly runtime errors are fully recoverably without special
 // action by the programmer.  Exceptions include malformed requests
-// such as invalid Bind requests or invalid Creds.
+// such as invalid Bind requests or invalid Creds.  Implement ErrorHooks
+// as well to receive the error itself rather than its string.
 type Hooks interface {
 	AuthHook(c *Client, err error)
 	BindHook(c *Client, req *BindReq)
@@ -189,6 +209,16 @@ type fq_cmd_instr struct {
 		}
 		return_value int
 	}
+	// resp, if set, receives the outcome of the request in place
+	// of the hooks being invoked.
+	resp chan error
+	// rebind, if set, is the tracked binding this request replays
+	// and old_routes the route ids it had before.
+	rebind     *binding
+	old_routes []uint32
+	// keep tracks the binding for replay on its own, even with
+	// rebinding disabled, as a Subscription's is.
+	keep bool
 }
 type hookReq struct {
 	htype hookType
@@ -198,15 +228,71 @@ type backMessage struct {
 	msg  *Message
 	hreq *hookReq
 }
+
+// frontMessage is a message waiting to be published.  done, if set,
+// receives the outcome once the message is written or abandoned.
+type frontMessage struct {
+	msg  *Message
+	done chan error
+}
+
+func (m *frontMessage) confirm(err error) {
+	if m.done != nil {
+		m.done <- err
+	}
+}
+
+// session is a single authenticated command connection.  The data
+// connection established for it lives no longer than the session.
+type session struct {
+	key  fq_rk
+	addr string
+	done chan struct{}
+	// enc and dec frame the command connection.
+	enc *wire.Encoder
+	dec *wire.Decoder
+}
+
+func (sess *session) ended() bool {
+	select {
+	case <-sess.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Client is an fq client.  Its settings are safe to change from any
+// goroutine, though most only take effect on the next (re)connect.
+//
+// The connection is managed by two goroutines: worker drives the
+// command connection and data_worker drives the data connection.  The
+// worker hands each authenticated session to data_worker over signal;
+// neither touches the other's connection directly.  All other shared
+// state is either guarded by mu/hb_mu/auth_mu or atomic.
+//
+// The exported Error field is kept for compatibility, but cannot be
+// read safely while the Client is running; use LastError instead.
 type Client struct {
 	host                          string
 	port                          uint16
 	last_resolve                  time.Time
+	server_specs                  []string
+	servers                       []*server
+	cur_server                    string
+	selection                     ServerSelection
+	failover_cooldown             time.Duration
+	resolve_interval              time.Duration
 	Error                         *string
 	user, pass, queue, queue_type string
-	key                           fq_rk
-	cmd_conn, data_conn           net.Conn
-	stop                          bool
+	dial_timeout                  time.Duration
+	tls_config                    *tls.Config
+	dialer                        Dialer
+	mu                            sync.Mutex
+	backoff                       BackoffPolicy
+	last_error                    error
+	hooks                         Hooks
+	connected                     bool
 	hb_mu                         sync.RWMutex
 	cmd_hb_needed                 bool
 	cmd_hb_interval               time.Duration
@@ -214,21 +300,42 @@ type Client struct {
 	cmd_hb_last                   time.Time
 	peermode                      bool
 	qmaxlen                       int
-	non_blocking                  bool
-	connected                     bool
-	data_ready                    bool
-	sync_hooks                    bool
+	overflow_policy               atomic.Pointer[OverflowPolicy]
+	overflow_stats                overflow_counters
+	receive_policy                atomic.Pointer[ReceivePolicy]
+	receive_stats                 overflow_counters
+	receive_warned                atomic.Bool // for backq
+	data_ready                    atomic.Bool
+	sync_hooks                    atomic.Bool
+	rebind                        atomic.Bool
+	bindings                      []*binding
+	subs                          atomic.Pointer[[]*Subscription]
 	cmdq                          chan *fq_cmd_instr
-	q                             chan *Message
+	q                             chan *frontMessage
+	resend                        []*frontMessage
+	batch_size                    int
+	batch_linger                  time.Duration
+	max_payload, max_hops         int
+	pub_limits                    atomic.Pointer[publish_limits]
+	spool                         *spool
 	backq                         chan *backMessage
-	hooks                         Hooks
-	enqueue_mu                    sync.Mutex
-	signal, done_cmd, done_data   chan bool
+	hook_mu                       sync.Mutex
+	hookq                         []*backMessage // guarded by hook_mu
+	hook_ready                    chan struct{}
+	signal                        chan *session
+	closing, closed, quit         chan struct{}
+	closing_once, quit_once       sync.Once
+	pub_mu                        sync.RWMutex
+	done_cmd, done_data           chan bool
+	worker_id                     atomic.Uint64
+	auth_mu                       sync.Mutex
+	auth_waiters                  []chan error
 }
 
 // Rk will take an input string and build an fq_rk that is used
 // extensively throughout the fq system.  This should be used to
-// assign to Exchange and Route in various objects.
+// assign to Exchange and Route in various objects.  Names longer
+// than FQ_MAX_RK_LEN are truncated; use NewRk to have them rejected.
 func Rk(str string) fq_rk {
 	input := []byte(str)
 	inlen := len(input)
@@ -273,11 +380,17 @@ func (id *fq_msgid) GetUint64() (uint64, uint64) {
 }
 
 // NewMessage composes a new fq Message with the supplied exchange, route
-// and payload.
+// and payload.  An exchange or route longer than FQ_MAX_RK_LEN is
+// truncated, and Publish refuses the message with a *LimitError.
 func NewMessage(exchange, route string, payload []byte) *Message {
 	msg := &Message{}
-	msg.Exchange = Rk(exchange)
-	msg.Route = Rk(route)
+	var err error
+	if msg.Exchange, err = checked_rk("exchange", exchange); err != nil {
+		msg.truncated = err
+	}
+	if msg.Route, err = checked_rk("route", route); err != nil && msg.truncated == nil {
+		msg.truncated = err
+	}
 	if payload != nil {
 		msg.Payload = payload
 	}
@@ -287,28 +400,70 @@ func NewMessage(exchange, route string, payload []byte) *Message {
 
 func (c *Client) error(err error) {
 	var errorstr string = err.Error()
+	c.mu.Lock()
 	c.Error = &errorstr
-	if c.hooks != nil {
-		c.hooks.ErrorLogHook(c, errorstr)
+	c.last_error = err
+	hooks := c.hooks
+	c.mu.Unlock()
+	if eh, ok := hooks.(ErrorHooks); ok {
+		eh.ErrorHook(c, err)
+	} else if hooks != nil {
+		hooks.ErrorLogHook(c, errorstr)
+	}
+}
+
+// LastError returns the most recent error encountered by the Client,
+// or nil if there has been none.
+func (c *Client) LastError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last_error
+}
+
+func (c *Client) get_hooks() Hooks {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hooks
+}
+
+// stopping reports whether the Client has been told to stop.
+func (c *Client) stopping() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
 	}
 }
 
-func internalClient(peermode bool) Client {
-	conn := Client{}
+// halt tells the worker goroutines to stop.
+func (c *Client) halt() {
+	c.quit_once.Do(func() { close(c.quit) })
+}
+
+func internalClient(peermode bool) *Client {
+	conn := &Client{}
 	conn.qmaxlen = 10000
+	conn.batch_size = DefaultBatchSize
+	conn.dial_timeout = 2 * time.Second
+	conn.failover_cooldown = default_failover_cooldown
+	conn.resolve_interval = default_resolve_interval
 	conn.peermode = peermode
+	conn.rebind.Store(true)
 	conn.SetHeartBeat(time.Second)
 	return conn
 }
 
-// NewClient creates a new (regular) fq client
-func NewClient() Client {
+// NewClient creates a new (regular) fq client.  It returns a
+// *Client: a Client holds locks and must not be copied.
+func NewClient() *Client {
 	conn := internalClient(false)
 	return conn
 }
 
-// NewClient creates a new fq client in peering mode
-func NewPeer() Client {
+// NewPeer creates a new fq client in peering mode.  Like NewClient,
+// it returns a *Client.
+func NewPeer() *Client {
 	conn := internalClient(true)
 	return conn
 }
@@ -317,17 +472,25 @@ func NewPeer() Client {
 // only in the context of the Receive method (thus
 // local to the go thread calling Receive.  One should
 // use this method if the Hooks implemented are not
-// safe for concurrent calling.
+// safe for concurrent calling.  MessageHook and the
+// error hooks are the exception and are still called
+// from the Client's own go routines.
 func (c *Client) SetSynchronous(synchronous bool) {
-	c.sync_hooks = synchronous
+	c.sync_hooks.Store(synchronous)
 }
 
 // SetHooks sets the set of hooks to be used by the
 // connection to control interaction.  It is safe to
 // interact with the Client inside the hooks.  A standard
 // pattern would be to invoke a c.Bind(...) from within
-// the AuthHook implementation.
+// the AuthHook implementation, with rebinding disabled
+// (see SetRebind).  Unless in synchronous mode, the hooks
+// run on the go routine that carries out commands, so
+// BindContext and the other blocking calls fail there
+// with ErrWouldDeadlock.
 func (c *Client) SetHooks(hooks Hooks) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.hooks = hooks
 }
 
@@ -340,14 +503,25 @@ func (c *Client) Creds(host string, port uint16, sender, pass string) error {
 	if c.user != "" {
 		return fmt.Errorf("Creds already called")
 	}
+	var queue, queue_type string
 	sparts := strings.SplitN(sender, "/", 3)
-	c.user = sparts[0]
 	if len(sparts) > 1 {
-		c.queue = sparts[1]
+		queue = sparts[1]
 		if len(sparts) > 2 {
-			c.queue_type = sparts[2]
+			queue_type = sparts[2]
 		}
-	} else {
+	}
+	c.init_creds(host, port, sparts[0], queue, queue_type, pass)
+	return nil
+}
+
+// init_creds applies already parsed credentials and allocates the
+// internal queues, generating a queue name if none is supplied.
+func (c *Client) init_creds(host string, port uint16, user, queue, queue_type, pass string) {
+	c.user = user
+	c.queue = queue
+	c.queue_type = queue_type
+	if c.queue == "" {
 		myname, err := os.Hostname()
 		if err != nil {
 			myname = "unknown"
@@ -366,13 +540,16 @@ func (c *Client) Creds(host string, port uint16, sender, pass string) error {
 	c.pass = pass
 
 	c.cmdq = make(chan *fq_cmd_instr, 1000)
-	c.q = make(chan *Message, c.qmaxlen)
+	c.q = make(chan *frontMessage, c.qmaxlen)
 	c.backq = make(chan *backMessage, c.qmaxlen)
-	c.signal = make(chan bool, 1)
+	c.hook_ready = make(chan struct{}, 1)
+	c.signal = make(chan *session, 1)
+	c.closing = make(chan struct{})
+	c.closed = make(chan struct{})
+	c.quit = make(chan struct{})
 
 	c.host = host
 	c.port = port
-	return nil
 }
 
 // SetHeartBeat will set the Duration of the heartbeating.
@@ -387,7 +564,7 @@ func (c *Client) SetHeartBeat(interval time.Duration) {
 	c.cmd_hb_interval = interval
 	c.cmd_hb_max_age = 3 * interval
 	c.hb_mu.Unlock()
-	if c.data_ready {
+	if c.data_ready.Load() {
 		c.HeartBeat()
 	}
 }
@@ -425,6 +602,11 @@ func (c *Client) Bind(req *BindReq) {
 	if c.cmdq == nil {
 		return
 	}
+	req.compile()
+	if err := c.check_bind(req); err != nil {
+		c.error(err)
+		return
+	}
 	e := &fq_cmd_instr{cmd: fq_PROTO_BINDREQ}
 	e.data.bind = req
 	c.cmdq <- e
@@ -453,6 +635,93 @@ func (c *Client) Status() {
 	c.cmdq <- e
 }
 
+// request sends a command upstream and waits for the server's response
+// or for ctx to be done, failing with ErrClosed once the Client has
+// stopped.  Hooks are not invoked for the request.  It fails with
+// ErrWouldDeadlock if called by the worker, which would never get
+// around to sending it.
+func (c *Client) request(ctx context.Context, e *fq_cmd_instr) error {
+	if c.cmdq == nil {
+		return fmt.Errorf("%w: Creds must be called before issuing commands", ErrNotConnected)
+	}
+	if c.worker_id.Load() == goid() {
+		return ErrWouldDeadlock
+	}
+	e.resp = make(chan error, 1)
+	select {
+	case c.cmdq <- e:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.quit:
+		return ErrClosed
+	}
+	select {
+	case err := <-e.resp:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.quit:
+		return ErrClosed
+	}
+}
+
+// BindContext is like Bind, but blocks until the server has responded
+// or ctx is done.  The BindHook is not invoked.  On success the route
+// id is returned and also set in req.OutRouteId.  If the server
+// rejects the binding, FQ_BIND_ILLEGAL is returned with an error.
+// Called from a hook that runs on the Client's command go routine, it
+// fails with ErrWouldDeadlock; use Bind there.
+func (c *Client) BindContext(ctx context.Context, req *BindReq) (uint32, error) {
+	return c.bind_context(ctx, req, false)
+}
+
+func (c *Client) bind_context(ctx context.Context, req *BindReq, keep bool) (uint32, error) {
+	req.compile()
+	if err := c.check_bind(req); err != nil {
+		return FQ_BIND_ILLEGAL, err
+	}
+	e := &fq_cmd_instr{cmd: fq_PROTO_BINDREQ, keep: keep}
+	e.data.bind = req
+	if err := c.request(ctx, e); err != nil {
+		return FQ_BIND_ILLEGAL, err
+	}
+	if req.OutRouteId == FQ_BIND_ILLEGAL {
+		return FQ_BIND_ILLEGAL, fmt.Errorf("%w: %s, %s", ErrBindFailed,
+			req.Exchange.ToString(), req.Program)
+	}
+	return req.OutRouteId, nil
+}
+
+// UnbindContext is like Unbind, but blocks until the server has
+// responded or ctx is done.  The UnbindHook is not invoked.
+// req.OutSuccess is filled in and an error is returned if the server
+// reports the unbind as unsuccessful.  Like BindContext, it fails
+// with ErrWouldDeadlock from hooks run on the command go routine.
+func (c *Client) UnbindContext(ctx context.Context, req *UnbindReq) error {
+	e := &fq_cmd_instr{cmd: fq_PROTO_UNBINDREQ}
+	e.data.unbind = req
+	if err := c.request(ctx, e); err != nil {
+		return err
+	}
+	if req.OutSuccess == 0 {
+		return fmt.Errorf("%w: %s, %d", ErrUnbindFailed,
+			req.Exchange.ToString(), req.RouteId)
+	}
+	return nil
+}
+
+// StatusContext is like Status, but blocks until the server has
+// responded or ctx is done, returning the statistics directly.
+// The StatusHook is not invoked.  Like BindContext, it fails with
+// ErrWouldDeadlock from hooks run on the command go routine.
+func (c *Client) StatusContext(ctx context.Context) (map[string]uint32, error) {
+	e := &fq_cmd_instr{cmd: fq_PROTO_STATUSREQ}
+	if err := c.request(ctx, e); err != nil {
+		return nil, err
+	}
+	return e.data.status.vals, nil
+}
+
 // SetBacklog controls the channel capacity of the internal message
 // queue.  The deault it 10000, this must be called prior to Creds.
 // If it is called subsequent to Creds, it has no effect.  SetBacklog
@@ -468,76 +737,267 @@ func (c *Client) SetBacklog(len int) int {
 // SetNonBlocking controls the behavior or Publish.  If this is set
 // to true, Publish will return immediately when the message would
 // exceed the maximum specified backlog.  If it is set to false
-// (default), Publish will block.
+// (default), Publish will block.  It is shorthand for the
+// OverflowDropNewest and OverflowBlock policies (see
+// SetOverflowPolicy).
 func (c *Client) SetNonBlocking(nonblock bool) {
-	c.non_blocking = nonblock
+	action := OverflowBlock
+	if nonblock {
+		action = OverflowDropNewest
+	}
+	c.SetOverflowPolicy(OverflowPolicy{Action: action})
 }
 
 // Connect establishes a connection to and fq server (as specified by
 // by a prior call to Creds).
 func (c *Client) Connect() error {
+	c.mu.Lock()
+	var err error
 	if c.user == "" {
-		err := fmt.Errorf("Creds must be called before Connect")
-		c.error(err)
-		return err
+		err = fmt.Errorf("Creds must be called before Connect")
+	} else if c.connected {
+		err = fmt.Errorf("Already connected")
 	}
-	if c.connected {
-		err := fmt.Errorf("Already connected")
+	if err != nil {
+		c.mu.Unlock()
 		c.error(err)
 		return err
 	}
 	c.done_data = make(chan bool, 1)
 	c.done_cmd = make(chan bool, 1)
 	c.connected = true
+	c.mu.Unlock()
 
 	go c.worker()
 	go c.data_worker()
 	return nil
 }
 
+// ConnectContext is like Connect, but blocks until the first
+// authentication attempt has completed or ctx is done.  The result
+// of authentication is returned (AuthHook is still invoked).  If
+// the server cannot be reached, ConnectContext waits (while the
+// Client retries) until ctx is done.  In either failure case the
+// Client remains connecting in the background.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	ready := make(chan error, 1)
+	c.auth_mu.Lock()
+	c.auth_waiters = append(c.auth_waiters, ready)
+	c.auth_mu.Unlock()
+	err := c.Connect()
+	if err == nil {
+		select {
+		case err = <-ready:
+			return err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	c.auth_mu.Lock()
+	for i, w := range c.auth_waiters {
+		if w == ready {
+			c.auth_waiters = append(c.auth_waiters[:i], c.auth_waiters[i+1:]...)
+			break
+		}
+	}
+	c.auth_mu.Unlock()
+	return err
+}
+
+func (c *Client) notify_auth(err error) {
+	c.auth_mu.Lock()
+	waiters := c.auth_waiters
+	c.auth_waiters = nil
+	c.auth_mu.Unlock()
+	for _, w := range waiters {
+		w <- err
+	}
+}
+
 // Shutdown disconnects from fq and waits for any queued message
 // to be published.  Note that if you cannot connect to complete
-// publication, this can hang.
+// publication, this can hang; use Close to bound the wait.
 func (c *Client) Shutdown() {
-	close(c.q)
-	<-c.done_data
-	<-c.done_cmd
+	c.Close(context.Background())
+}
+
+// Close disconnects from fq, first attempting to publish any queued
+// messages until ctx is done.  Messages that could not be published
+// are returned along with ctx's error.  Publish fails once Close has
+// been called.  Close waits for all of the Client's go routines
+// (including the heartbeat ticker and command receiver) to exit and
+// may safely be called more than once; later calls return nothing.
+func (c *Client) Close(ctx context.Context) ([]*Message, error) {
+	if c.closing == nil {
+		return nil, nil
+	}
+	first := false
+	c.closing_once.Do(func() { close(c.closing); first = true })
+	if !first {
+		select {
+		case <-c.closed:
+		default:
+			select {
+			case <-c.closed:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return nil, nil
+	}
+	defer close(c.closed)
+	// Wait out any Publish in progress; none may enqueue after this.
+	c.pub_mu.Lock()
+	c.pub_mu.Unlock()
+
+	c.mu.Lock()
+	connected := c.connected
+	c.mu.Unlock()
+
+	var err error
+	if connected {
+		// data_sender halts the Client once the backlog is drained
+		select {
+		case <-c.done_data:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	c.halt()
+	if connected {
+		<-c.done_data
+		<-c.done_cmd
+	}
+	if c.spool != nil {
+		c.spool.close()
+	}
+
+	left := c.resend
+	c.resend = nil
+	for {
+		select {
+		case m := <-c.q:
+			left = append(left, m)
+			continue
+		default:
+		}
+		break
+	}
+	if len(left) > 0 && err == nil {
+		err = ErrNotConnected
+	}
+	var undelivered []*Message
+	for _, m := range left {
+		m.confirm(err)
+		undelivered = append(undelivered, m.msg)
+	}
+	return undelivered, err
 }
 
 // DataBacklog returns the current number of messages queued
-// waiting to be sent.
+// waiting to be sent, including those spooled.
 func (c *Client) DataBacklog() int {
+	if c.spool != nil {
+		return c.spool.backlog()
+	}
 	return len(c.q)
 }
 
 // Publish schedules a message for publication returning
 // true if successful or false if the queue is full and the
-// client is set to non blocking mode.
+// OverflowPolicy refuses it.  Publish returns false
+// once Close (or Shutdown) has been called, and for a message
+// exceeding the limits set by SetPublishLimits, which is reported
+// as a *LimitError to the error hooks.  TryPublish returns the
+// reason instead.
 func (c *Client) Publish(msg *Message) bool {
-	if c.non_blocking {
-		c.enqueue_mu.Lock()
-		defer c.enqueue_mu.Unlock()
-		if len(c.q) >= c.qmaxlen {
-			return false
+	if err := c.check_message(msg); err != nil {
+		c.error(err)
+		return false
+	}
+	return c.enqueue(&frontMessage{msg: msg}) == nil
+}
+
+// TryPublish schedules a message for publication like Publish, but
+// returns why it was not: a *LimitError for a message exceeding the
+// limits set by SetPublishLimits, an error wrapping ErrBacklogFull if
+// the OverflowPolicy refuses it, or ErrClosed after Close.  Nothing
+// is reported to the error hooks.  PublishAsync also reports whether
+// the message was written.
+func (c *Client) TryPublish(msg *Message) error {
+	if err := c.check_message(msg); err != nil {
+		return err
+	}
+	return c.enqueue(&frontMessage{msg: msg})
+}
+
+// PublishAsync schedules a message for publication like Publish, and
+// returns a channel that receives exactly one value: nil once the
+// message has been written to the data connection, or the reason it
+// was not.  If the queue is full and the OverflowPolicy refuses or
+// later drops the message, the error wraps ErrBacklogFull, after
+// Close it is ErrClosed, and for a message exceeding the limits set
+// by SetPublishLimits it is a *LimitError, available before
+// PublishAsync returns.  A message whose
+// write fails is sent again, ahead of the rest of the queue, once
+// the connection is reestablished.  As the write may have partially
+// succeeded, the server can see such a message twice.
+func (c *Client) PublishAsync(msg *Message) <-chan error {
+	m := &frontMessage{msg: msg, done: make(chan error, 1)}
+	if err := c.check_message(msg); err != nil {
+		m.confirm(err)
+	} else if err := c.enqueue(m); err != nil {
+		m.confirm(err)
+	}
+	return m.done
+}
+
+func (c *Client) enqueue(m *frontMessage) error {
+	c.pub_mu.RLock()
+	defer c.pub_mu.RUnlock()
+	select {
+	case <-c.closing:
+		return ErrClosed
+	case <-c.quit:
+		return ErrClosed
+	default:
+	}
+	if c.spool != nil {
+		if err := c.spool.append(m.msg); err != nil {
+			return err
 		}
-		c.q <- msg
-	} else {
-		c.q <- msg
+		m.confirm(nil)
+		return nil
+	}
+	if p := c.overflow_policy.Load(); p != nil && p.Action != OverflowBlock {
+		return c.overflow(p, m)
+	}
+	select {
+	case c.q <- m:
+		return nil
+	case <-c.closing:
+		return ErrClosed
+	case <-c.quit:
+		return ErrClosed
 	}
-	return true
 }
 
 func (c *Client) handle_hook(e *fq_cmd_instr) {
-	if c.hooks == nil {
+	hooks := c.get_hooks()
+	if hooks == nil {
 		return
 	}
 	switch e.cmd {
 	case fq_PROTO_BINDREQ:
-		c.hooks.BindHook(c, e.data.bind)
+		if e.rebind != nil {
+			c.rebound(hooks, e)
+			return
+		}
+		hooks.BindHook(c, e.data.bind)
 	case fq_PROTO_UNBINDREQ:
-		c.hooks.UnbindHook(c, e.data.unbind)
+		hooks.UnbindHook(c, e.data.unbind)
 	case fq_PROTO_STATUSREQ:
-		c.hooks.StatusHook(c, e.data.status.vals)
+		hooks.StatusHook(c, e.data.status.vals)
 	}
 }
 
@@ -546,18 +1006,24 @@ func (c *Client) processBackMessage(bm *backMessage) *Message {
 		e := bm.hreq.entry
 		switch bm.hreq.htype {
 		case fq_AUTH_HOOK_TYPE:
-			if c.sync_hooks && c.hooks != nil {
-				c.hooks.AuthHook(c, e.data.auth.err)
+			if hooks := c.get_hooks(); hooks != nil {
+				hooks.AuthHook(c, e.data.auth.err)
 			}
 		case fq_CMD_HOOK_TYPE:
 			c.handle_hook(e)
-		default:
-			if c.hooks != nil {
-				c.hooks.ErrorLogHook(c, fmt.Sprintf("sync cmd feedback unknown: %v", e.cmd))
+		case fq_DISCONNECT_HOOK_TYPE:
+			if hooks := c.get_hooks(); hooks != nil {
+				hooks.DisconnectHook(c)
 			}
+		default:
+			c.error(fmt.Errorf("sync hook feedback unknown: %v", bm.hreq.htype))
 		}
+		return nil
 	}
-	return bm.msg
+	msg := bm.msg
+	bm.msg = nil
+	back_pool.Put(bm)
+	return msg
 }
 
 // Receive will attempt to receive a message from fq.  If the client
@@ -566,132 +1032,192 @@ func (c *Client) processBackMessage(bm *backMessage) *Message {
 // call will wait for an available message.  If block is false, nil
 // will be returned if no message is immediately available.
 func (c *Client) Receive(block bool) *Message {
-	if block {
-		for {
+	for {
+		// Deferred hooks go first.
+		if bm := c.next_hook(); bm != nil {
+			c.processBackMessage(bm)
+			continue
+		}
+		if !block {
 			select {
 			case bm := <-c.backq:
-				if msg := c.processBackMessage(bm); msg != nil {
-					return msg
-				}
+				return c.processBackMessage(bm)
+			default:
+				return nil
 			}
 		}
+		select {
+		case <-c.hook_ready:
+		case bm := <-c.backq:
+			return c.processBackMessage(bm)
+		}
+	}
+}
+
+// next_hook takes the oldest deferred hook, if any.
+func (c *Client) next_hook() *backMessage {
+	c.hook_mu.Lock()
+	defer c.hook_mu.Unlock()
+	if len(c.hookq) == 0 {
+		return nil
 	}
+	bm := c.hookq[0]
+	c.hookq[0] = nil
+	c.hookq = c.hookq[1:]
+	return bm
+}
 
-	select {
-	case bm := <-c.backq:
-		if msg := c.processBackMessage(bm); msg != nil {
-			return msg
+// dial connects to the server, giving up after the dial timeout or
+// as soon as the Client is halted.
+func (c *Client) dial(addr string) (net.Conn, error) {
+	c.mu.Lock()
+	timeout, config, dialer := c.dial_timeout, c.tls_config, c.dialer
+	name := c.server_name(addr)
+	c.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go (func() {
+		select {
+		case <-c.quit:
+			cancel()
+		case <-ctx.Done():
 		}
-	default:
+	})()
+	conn, err := dial_with(ctx, dialer, addr)
+	if err != nil || config == nil {
+		return conn, err
 	}
-	return nil
+	return start_tls(ctx, conn, config, name)
+}
+
+// abort_on_halt closes conn if the Client is halted before the
+// returned function is called, so handshakes cannot outlive Close.
+func (c *Client) abort_on_halt(conn net.Conn) func() {
+	done := make(chan struct{})
+	go (func() {
+		select {
+		case <-c.quit:
+			conn.Close()
+		case <-done:
+		}
+	})()
+	return func() { close(done) }
 }
 
-func (c *Client) data_connect_internal() (net.Conn, error) {
-	cmd := uint32(fq_PROTO_DATA_MODE)
+func (c *Client) data_connect_internal(sess *session) (net.Conn, error) {
+	mode := wire.DataMode
 	if c.peermode {
-		cmd = uint32(fq_PROTO_PEER_MODE)
-	}
-	if c.cmd_conn == nil {
-		return nil, fmt.Errorf("no cmd connection")
+		mode = wire.PeerMode
 	}
-	connstr := fmt.Sprintf("%s:%d", c.host, c.port)
-	timeout := time.Duration(2) * time.Second
-	conn, err := net.DialTimeout("tcp", connstr, timeout)
+	conn, err := c.dial(sess.addr)
 	if err != nil {
 		return conn, err
 	}
-	conn.(*net.TCPConn).SetNoDelay(false)
-	err = fq_write_uint32(conn, cmd)
-	if err != nil {
+	defer c.abort_on_halt(conn)()
+	enc := wire.NewEncoder(conn)
+	if err = enc.EncodeMode(mode); err != nil {
 		return conn, err
 	}
-	if err := fq_write_short_cmd(conn, uint16(c.key.Len), c.key.Name[:]); err != nil {
+	if err = enc.EncodeSessionKey(sess.key.Name[:sess.key.Len]); err != nil {
 		return conn, err
 	}
 	return conn, nil
 }
-func (c *Client) do_auth() error {
-	if err := fq_write_uint16(c.cmd_conn, uint16(fq_PROTO_AUTH_CMD)); err != nil {
-		return fmt.Errorf("auth:cmd:" + err.Error())
-	}
-	if err := fq_write_uint16(c.cmd_conn, uint16(fq_PROTO_AUTH_PLAIN)); err != nil {
-		return fmt.Errorf("auth:plain:" + err.Error())
-	}
-	user_bytes := []byte(c.user)
-	if err := fq_write_short_cmd(c.cmd_conn, uint16(len(user_bytes)), user_bytes); err != nil {
-		return fmt.Errorf("auth:user:" + err.Error())
-	}
-	queue_composed := make([]byte, 0, 256)
-	queue_composed = append(queue_composed, []byte(c.queue)...)
-	queue_composed = append(queue_composed, byte(0))
-	queue_composed = append(queue_composed, []byte(c.queue_type)...)
-	if err := fq_write_short_cmd(c.cmd_conn, uint16(len(queue_composed)), queue_composed); err != nil {
-		return fmt.Errorf("auth:queue:" + err.Error())
+func (c *Client) do_auth(sess *session) error {
+	err := sess.enc.Encode(&wire.Auth{
+		User:      c.user,
+		Password:  c.pass,
+		Queue:     c.queue,
+		QueueType: c.queue_type,
+	})
+	if err != nil {
+		return fmt.Errorf("auth:cmd:%w", err)
 	}
-	pass_bytes := []byte(c.pass)
-	if err := fq_write_short_cmd(c.cmd_conn, uint16(len(pass_bytes)), pass_bytes); err != nil {
-		return fmt.Errorf("auth:pass:" + err.Error())
+	f, err := sess.dec.Decode()
+	if err != nil {
+		var unknown *wire.UnknownCommandError
+		if errors.As(err, &unknown) {
+			err = &ProtocolViolationError{Command: uint16(unknown.Command), Expected: "auth response"}
+			return fmt.Errorf("auth:proto: %w", err)
+		}
+		return fmt.Errorf("auth:response:%w", err)
 	}
-	if cmd, err := fq_read_uint16(c.cmd_conn); err != nil {
-		return fmt.Errorf("auth:response:" + err.Error())
-	} else {
-		switch cmd {
-		case uint16(fq_PROTO_ERROR):
-			return fmt.Errorf("auth:proto_error")
-		case uint16(fq_PROTO_AUTH_RESP):
-			if klen, err := fq_read_uint16(c.cmd_conn); err != nil || klen > uint16(cap(c.key.Name)) {
-				return fmt.Errorf("auth:key:" + err.Error())
-			} else {
-				err = fq_read_complete(c.cmd_conn, c.key.Name[:], int(klen))
-				if err != nil {
-					return fmt.Errorf("auth:key:" + err.Error())
-				}
-				c.key.Len = uint8(klen)
-			}
-			c.data_ready = true
-		default:
-			if c.hooks != nil {
-				c.hooks.ErrorLogHook(c, fmt.Sprintf("server auth response 0x%04x unknown", cmd))
-			}
-			return fmt.Errorf("auth:proto")
+	switch f := f.(type) {
+	case *wire.Error:
+		// The server follows up with a reason before hanging up.
+		return fmt.Errorf("auth:proto_error: %w: %s", ErrAuthFailed, f.Reason)
+	case *wire.AuthResponse:
+		if len(f.Key) > len(sess.key.Name) {
+			return fmt.Errorf("auth:key: too long: %d", len(f.Key))
 		}
+		sess.key.Len = uint8(copy(sess.key.Name[:], f.Key))
+	default:
+		return fmt.Errorf("auth:proto: %w",
+			&ProtocolViolationError{Command: uint16(f.Command()), Expected: "auth response"})
 	}
 	return nil
 }
-func (c *Client) connect_internal() (net.Conn, error) {
-	connstr := fmt.Sprintf("%s:%d", c.host, c.port)
-	timeout := time.Duration(2) * time.Second
-	conn, err := net.DialTimeout("tcp", connstr, timeout)
+func (c *Client) connect_internal(addr string) (net.Conn, *session, error) {
+	conn, err := c.dial(addr)
 	if err != nil {
-		return conn, err
+		return conn, nil, err
 	}
-	c.cmd_conn = conn
-	if err = fq_write_uint32(conn, uint32(fq_PROTO_CMD_MODE)); err != nil {
-		return conn, err
+	defer c.abort_on_halt(conn)()
+	sess := &session{
+		addr: addr,
+		done: make(chan struct{}),
+		enc:  wire.NewEncoder(conn),
+		dec:  wire.NewDecoder(conn),
+	}
+	if err = sess.enc.EncodeMode(wire.CmdMode); err != nil {
+		return conn, nil, err
 	}
-	err = c.do_auth()
-	if c.hooks != nil {
-		if c.sync_hooks {
-			bm := &backMessage{hreq: &hookReq{}}
-			bm.hreq.htype = fq_AUTH_HOOK_TYPE
-			bm.hreq.entry.data.auth.err = err
-			c.backq <- bm
+	err = c.do_auth(sess)
+	if err == nil {
+		c.data_ready.Store(true)
+	}
+	c.notify_auth(err)
+	if hooks := c.get_hooks(); hooks != nil {
+		if c.sync_hooks.Load() {
+			e := &fq_cmd_instr{cmd: fq_PROTO_AUTH_CMD}
+			e.data.auth.err = err
+			c.defer_hook(fq_AUTH_HOOK_TYPE, e)
 		} else {
-			c.hooks.AuthHook(c, err)
+			hooks.AuthHook(c, err)
 		}
 	}
-	c.HeartBeat()
-	return conn, err
+	if err != nil {
+		return conn, nil, err
+	}
+	// Request heartbeats directly; the worker that would otherwise
+	// consume the request from cmdq is the one calling us.
+	e := &fq_cmd_instr{cmd: fq_PROTO_HBREQ}
+	c.hb_mu.RLock()
+	e.data.heartbeat.interval = c.cmd_hb_interval
+	c.hb_mu.RUnlock()
+	if err = c.command_send(sess, e, nil); err != nil {
+		return conn, nil, err
+	}
+	return conn, sess, nil
 }
 
-func (c *Client) command_receiver(cmds chan *fq_cmd_instr, cx_queue chan *fq_cmd_instr) {
+func (c *Client) command_receiver(sess *session, cmds chan *fq_cmd_instr, cx_queue chan *fq_cmd_instr) {
 	var req *fq_cmd_instr = nil
-	defer close(cmds)
+	defer (func() {
+		if req != nil {
+			req.fail(fmt.Errorf("%w: disconnected awaiting response", ErrNotConnected))
+		}
+		close(cmds)
+	})()
 	for {
-		cmd, err := fq_read_uint16(c.cmd_conn)
+		f, err := sess.dec.Decode()
 		if err != nil {
-			c.error(err)
+			var unknown *wire.UnknownCommandError
+			if errors.As(err, &unknown) {
+				c.error(&ProtocolViolationError{Command: uint16(unknown.Command)})
+			} else if !c.stopping() {
+				c.error(err)
+			}
 			return
 		}
 		if req == nil {
@@ -704,87 +1230,94 @@ func (c *Client) command_receiver(cmds chan *fq_cmd_instr, cx_queue chan *fq_cmd
 			default:
 			}
 		}
-		switch cmd {
-		case uint16(fq_PROTO_HB):
+		switch f := f.(type) {
+		case *wire.Heartbeat:
 			c.hb_mu.Lock()
 			c.cmd_hb_last = time.Now()
 			c.cmd_hb_needed = true
 			c.hb_mu.Unlock()
-		case uint16(fq_PROTO_STATUS):
+		case *wire.Status:
 			if req == nil || req.cmd != fq_PROTO_STATUSREQ {
-				c.error(fmt.Errorf("protocol violation (exp stats)"))
+				c.error(&ProtocolViolationError{Command: uint16(f.Command()), Expected: "stats"})
 				return
 			}
-			vals := make(map[string]uint32)
-			for {
-				klen, err := fq_read_uint16(c.cmd_conn)
-				if err != nil {
-					c.error(err)
-					return
-				}
-				if klen == 0 {
-					break
-				}
-				key := make([]byte, int(klen))
-				err = fq_read_complete(c.cmd_conn, key, int(klen))
-				if err != nil {
-					c.error(err)
-					return
-				}
-				val, err2 := fq_read_uint32(c.cmd_conn)
-				if err2 != nil {
-					c.error(err2)
-					return
-				}
-				vals[string(key)] = val
-			}
-			req.data.status.vals = vals
+			req.data.status.vals = f.Stats
 			cmds <- req
 			req = nil
-		case uint16(fq_PROTO_BIND):
+		case *wire.BindResponse:
 			if req == nil || req.cmd != fq_PROTO_BINDREQ {
-				c.error(fmt.Errorf("protocol violation (exp bind, %v)", req))
-				return
-			}
-			routeid, err := fq_read_uint32(c.cmd_conn)
-			if err != nil {
-				c.error(err)
+				c.error(&ProtocolViolationError{Command: uint16(f.Command()), Expected: "bind"})
 				return
 			}
-			req.data.bind.OutRouteId = routeid
+			req.data.bind.OutRouteId = f.RouteID
 			cmds <- req
 			req = nil
-		case uint16(fq_PROTO_UNBIND):
+		case *wire.UnbindResponse:
 			if req == nil || req.cmd != fq_PROTO_UNBINDREQ {
-				c.error(fmt.Errorf("protocol violation (exp unbind)"))
+				c.error(&ProtocolViolationError{Command: uint16(f.Command()), Expected: "unbind"})
 				return
 			}
-			success, err := fq_read_uint32(c.cmd_conn)
-			if err != nil {
-				c.error(err)
-				return
-			}
-			req.data.unbind.OutSuccess = success
+			req.data.unbind.OutSuccess = f.Success
 			cmds <- req
 			req = nil
 		default:
-			c.error(fmt.Errorf("protocol violation: %x", cmd))
+			c.error(&ProtocolViolationError{Command: uint16(f.Command())})
 			return
 		}
 	}
 }
-func (c *Client) command_send(req *fq_cmd_instr, cx_queue chan *fq_cmd_instr) error {
+
+// dispatch hands a completed command to whoever is waiting on it:
+// a blocking caller, Receive (in synchronous mode) or the hooks.
+func (c *Client) dispatch(cmd *fq_cmd_instr) {
+	c.track(cmd)
+	if cmd.rebind != nil && cmd.data.bind.OutRouteId == FQ_BIND_ILLEGAL {
+		c.error(fmt.Errorf("%w: rebind %s, %s", ErrBindFailed,
+			cmd.data.bind.Exchange.ToString(), cmd.data.bind.Program))
+		return
+	}
+	if cmd.resp != nil {
+		cmd.resp <- nil
+		return
+	}
+	if !c.sync_hooks.Load() {
+		c.handle_hook(cmd)
+	} else {
+		c.defer_hook(fq_CMD_HOOK_TYPE, cmd)
+	}
+}
+
+// defer_hook queues a hook invocation to be made from Receive when
+// in synchronous mode.  Hooks are delivered in the order queued,
+// ahead of any received messages waiting.  Their queue is unbounded,
+// so that neither received messages nor a slow Receive can hold up
+// the command connection, and no hook is ever dropped.
+func (c *Client) defer_hook(htype hookType, entry *fq_cmd_instr) {
+	bm := &backMessage{hreq: &hookReq{htype: htype, entry: entry}}
+	c.hook_mu.Lock()
+	c.hookq = append(c.hookq, bm)
+	c.hook_mu.Unlock()
+	select {
+	case c.hook_ready <- struct{}{}:
+	default:
+	}
+}
+
+// fail reports err to a blocking caller waiting on the command.
+func (e *fq_cmd_instr) fail(err error) {
+	if e.resp != nil {
+		e.resp <- err
+	}
+}
+
+func (c *Client) command_send(sess *session, req *fq_cmd_instr, cx_queue chan *fq_cmd_instr) error {
 	switch req.cmd {
 	case fq_PROTO_STATUSREQ:
 		cx_queue <- req
-		return fq_write_uint16(c.cmd_conn, uint16(req.cmd))
+		return sess.enc.Encode(&wire.StatusRequest{})
 	case fq_PROTO_HBREQ:
-		hb_ms := req.data.heartbeat.interval.Nanoseconds() /
-			time.Millisecond.Nanoseconds()
-		if err := fq_write_uint16(c.cmd_conn, uint16(req.cmd)); err != nil {
-			return err
-		}
-		if err := fq_write_uint16(c.cmd_conn, uint16(hb_ms)); err != nil {
+		err := sess.enc.Encode(&wire.HeartbeatRequest{Interval: req.data.heartbeat.interval})
+		if err != nil {
 			return err
 		}
 
@@ -794,54 +1327,38 @@ func (c *Client) command_send(req *fq_cmd_instr, cx_queue chan *fq_cmd_instr) er
 		c.hb_mu.Unlock()
 	case fq_PROTO_BINDREQ:
 		cx_queue <- req
-		if err := fq_write_uint16(c.cmd_conn, uint16(req.cmd)); err != nil {
-			return err
-		}
-		if err := fq_write_uint16(c.cmd_conn, req.data.bind.Flags); err != nil {
-			return err
-		}
-		if err := fq_write_short_cmd(c.cmd_conn,
-			uint16(req.data.bind.Exchange.Len),
-			req.data.bind.Exchange.Name[:]); err != nil {
-			return err
-		}
-		pbytes := []byte(req.data.bind.Program)
-		pbytes_len := uint16(len(pbytes))
-		if len(pbytes) != int(pbytes_len) {
-			return fmt.Errorf("program too long")
-		}
-		if err := fq_write_short_cmd(c.cmd_conn, pbytes_len, pbytes); err != nil {
-			return err
-		}
+		return sess.enc.Encode(&wire.BindRequest{
+			Flags:    req.data.bind.Flags,
+			Exchange: req.data.bind.Exchange.ToString(),
+			Program:  req.data.bind.Program,
+		})
 	case fq_PROTO_UNBINDREQ:
 		cx_queue <- req
-		if err := fq_write_uint16(c.cmd_conn, uint16(req.cmd)); err != nil {
-			return err
-		}
-		if err := fq_write_uint32(c.cmd_conn, req.data.unbind.RouteId); err != nil {
-			return err
-		}
-		if err := fq_write_short_cmd(c.cmd_conn,
-			uint16(req.data.unbind.Exchange.Len),
-			req.data.unbind.Exchange.Name[:]); err != nil {
-			return err
-		}
+		return sess.enc.Encode(&wire.UnbindRequest{
+			RouteID:  req.data.unbind.RouteId,
+			Exchange: req.data.unbind.Exchange.ToString(),
+		})
 	default:
 		return fmt.Errorf("can't send unknown cmd: %x", req.cmd)
 	}
 	return nil
 }
 func (c *Client) worker_loop() {
-	conn, err := c.connect_internal()
+	addr := c.next_server()
+	conn, sess, err := c.connect_internal(addr)
 	if err != nil {
 		if conn != nil {
 			conn.Close()
 		}
+		c.server_health(addr, false)
 		c.error(err)
-		c.signal <- true
+		// Let the data side pace our reconnection attempts
+		select {
+		case c.signal <- nil:
+		case <-c.quit:
+		}
 		return
 	}
-	// Let the data channel know it can move forward
 
 	// A go routine is started to read from the wire and put
 	// commands into the cmds channel
@@ -857,155 +1374,302 @@ func (c *Client) worker_loop() {
 
 	// this is like a Ticker, but adaptive to the interval changes
 	go (func(c *Client, hb chan bool, q chan bool) {
-		for keep_going := true; keep_going; {
-			select {
-			case <-q:
-				keep_going = false
-			default:
-			}
+		defer close(hb)
+		for {
 			c.hb_mu.RLock()
 			interval := c.cmd_hb_interval
 			c.hb_mu.RUnlock()
-			time.Sleep(interval)
+			select {
+			case <-q:
+				return
+			case <-time.After(interval):
+			}
 			select {
 			case hb <- true:
 			default:
 			}
 		}
-		close(hb)
 	})(c, hb_chan, hb_quit_chan)
 
 	// command_receiver writes to cmds, so it will close the channel
-	// we write to cx_queue via command_send, so we must clost this one
+	// we write to cx_queue via command_send, so we must clost this one.
+	// Once the receiver is gone, any responses it already read are
+	// dispatched and requests still awaiting a response are failed.
+	// Closing sess.done tears down the data connection.  Losing the
+	// session counts against the server unless we are stopping.
+	c.server_health(addr, true)
 	defer (func() {
-		close(cx_queue)
+		if !c.stopping() {
+			c.server_health(addr, false)
+		}
+		c.data_ready.Store(false)
 		close(hb_quit_chan)
+		for range hb_chan {
+		}
+		close(sess.done)
 		conn.Close()
-		c.data_ready = false
+		for cmd := range cmds {
+			c.dispatch(cmd)
+		}
+		close(cx_queue)
+		for req := range cx_queue {
+			req.fail(fmt.Errorf("%w: disconnected awaiting response", ErrNotConnected))
+		}
 	})()
-	c.signal <- true
-	go c.command_receiver(cmds, cx_queue)
-	for c.stop == false {
+	go c.command_receiver(sess, cmds, cx_queue)
+
+	// Let the data channel know it can move forward
+	select {
+	case c.signal <- sess:
+	case <-c.quit:
+		return
+	}
+	// Restore the bindings lost with the previous session first.
+	replayq := c.replay()
+	for {
+		// Stop taking new commands while cx_queue is full, so that
+		// command_send never blocks on it and we keep draining cmds.
+		cmdq := c.cmdq
+		if replayq != nil {
+			cmdq = nil
+		}
+		if len(cx_queue) == cap(cx_queue) {
+			cmdq, replayq = nil, nil
+		}
 		select {
+		case <-c.quit:
+			return
 		case cmd, ok := <-cmds:
 			if !ok {
 				c.error(fmt.Errorf("reading on command channel terminated"))
 				return
 			}
-			if !c.sync_hooks {
-				c.handle_hook(cmd)
-			} else {
-				bm := &backMessage{hreq: &hookReq{}}
-				bm.hreq.htype = fq_CMD_HOOK_TYPE
-				bm.hreq.entry = cmd
-				c.backq <- bm
+			c.dispatch(cmd)
+		case req := <-cmdq:
+			if err := c.command_send(sess, req, cx_queue); err != nil {
+				c.error(err)
+				return
 			}
-		case req, ok := <-c.cmdq:
+		case req, ok := <-replayq:
 			if !ok {
-				c.error(fmt.Errorf("client command queue closed"))
-				return
+				replayq = nil
+				continue
 			}
-			if err := c.command_send(req, cx_queue); err != nil {
+			if err := c.command_send(sess, req, cx_queue); err != nil {
 				c.error(err)
 				return
 			}
 		case <-hb_chan:
 			c.hb_mu.RLock()
-			if c.cmd_hb_needed {
-				c.hb_mu.RUnlock()
-				if err := fq_write_uint16(c.cmd_conn, uint16(fq_PROTO_HB)); err != nil {
+			needed := c.cmd_hb_needed
+			dead := c.cmd_hb_last.Before(time.Now().Add(-c.cmd_hb_max_age))
+			c.hb_mu.RUnlock()
+			if needed {
+				if err := sess.enc.Encode(&wire.Heartbeat{}); err != nil {
 					c.error(err)
 					return
 				}
-				needed_by := time.Now().Add(-c.cmd_hb_max_age)
-				if c.cmd_hb_last.Before(needed_by) {
-					c.error(fmt.Errorf("dead: missing heartbeat"))
+				if dead {
+					c.error(ErrHeartbeatTimeout)
 					return
 				}
-			} else {
-				c.hb_mu.RUnlock()
 			}
 		}
 	}
 }
 func (c *Client) worker() {
-	for c.stop == false {
+	c.worker_id.Store(goid())
+	for !c.stopping() {
 		c.worker_loop()
-		if c.hooks != nil {
-			c.hooks.DisconnectHook(c)
-		}
-		if c.data_conn != nil {
-			c.data_conn.Close()
+		if hooks := c.get_hooks(); hooks != nil {
+			if c.sync_hooks.Load() {
+				c.defer_hook(fq_DISCONNECT_HOOK_TYPE, nil)
+			} else {
+				hooks.DisconnectHook(c)
+			}
 		}
 	}
 	close(c.done_cmd)
 }
-func (c *Client) data_sender() {
-	defer c.data_conn.Close()
-	for c.data_ready && c.stop == false {
-		msg, ok := <-c.q
-		if !ok {
-			c.stop = true
+
+// data_sender writes queued messages to the data connection, in
+// batches (see SetBatching), until the session ends or the connection
+// fails.  Once Close has been requested, it drains the queue and
+// stops the Client.
+func (c *Client) data_sender(conn net.Conn, sess *session, flushed, rcv_done chan bool) {
+	if c.spool != nil {
+		c.spool_sender(conn, sess, flushed, rcv_done)
+		return
+	}
+	defer conn.Close()
+	c.mu.Lock()
+	b := &batch{max: c.batch_size, linger: c.batch_linger}
+	c.mu.Unlock()
+	for _, m := range c.resend {
+		c.add(b, m)
+	}
+	c.resend = nil
+	if !c.flush(conn, b) {
+		return
+	}
+	for {
+		select {
+		case <-sess.done:
 			return
+		case m := <-c.q:
+			if !c.send(conn, b, m, sess) {
+				return
+			}
+		case <-c.closing:
+			b.linger = 0
+			for {
+				select {
+				case m := <-c.q:
+					if !c.send(conn, b, m, sess) {
+						return
+					}
+				default:
+					c.hang_up(conn, sess, flushed, rcv_done)
+					return
+				}
+			}
 		}
-		err := fq_write_msg(c.data_conn, msg, c.peermode)
-		if err != nil {
-			return
+	}
+}
+
+// hang_up ends the data connection once everything has been sent
+// while closing, and stops the Client.  It half-closes and waits for
+// the server to hang up so that everything written is consumed before
+// the session is torn down.
+func (c *Client) hang_up(conn net.Conn, sess *session, flushed, rcv_done chan bool) {
+	if hc, ok := conn.(interface{ CloseWrite() error }); ok && hc.CloseWrite() == nil {
+		close(flushed)
+		select {
+		case <-rcv_done:
+		case <-sess.done:
+		case <-c.quit:
 		}
 	}
+	c.halt()
 }
-func (c *Client) data_receiver() {
-	for c.data_ready {
-		if msg, err := fq_read_msg(c.data_conn); err != nil {
-			c.error(err)
+
+func (c *Client) data_receiver(conn net.Conn, sess *session, flushed chan bool) {
+	dec := wire.NewDecoder(conn)
+	// We're always in peermode as a receiving client
+	dec.Peer = true
+	c.mu.Lock()
+	dec.MaxPayload, dec.MaxHops = c.max_payload, c.max_hops
+	c.mu.Unlock()
+	var wm wire.Message
+	for {
+		msg, err := fq_read_msg(dec, &wm)
+		if err != nil {
+			select {
+			case <-sess.done:
+			case <-c.quit:
+			case <-c.closing:
+			default:
+				c.error(err)
+			}
 			return
-		} else {
-			if msg != nil {
-				if c.hooks == nil || c.hooks.MessageHook(c, msg) == false {
-					c.backq <- &backMessage{msg: msg}
-				}
+		}
+		found, ok := c.demux(msg, sess, flushed)
+		if !ok {
+			return
+		}
+		if found {
+			continue
+		}
+		if hooks := c.get_hooks(); hooks == nil || hooks.MessageHook(c, msg) == false {
+			bm := back_pool.Get().(*backMessage)
+			bm.msg = msg
+			if action, ok := c.receive_dropping(); ok {
+				receive_drop(c, action, c.backq, bm, release_back, &c.receive_warned)
+				continue
+			}
+			select {
+			case c.backq <- bm:
+				c.receive_warn(&c.receive_warned, len(c.backq))
+			case <-sess.done:
+				return
+			case <-c.quit:
+				return
+			case <-flushed:
+				// We are closing and only reading until the server
+				// hangs up; nobody is left to take this.
 			}
 		}
 	}
 }
-func (c *Client) data_worker_loop() bool {
-	c.data_conn = nil
-	conn, err := c.data_connect_internal()
+func (c *Client) data_worker_loop(sess *session) bool {
+	conn, err := c.data_connect_internal(sess)
 	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
 		c.error(err)
 		return false
 	}
-	c.data_conn = conn
 	defer conn.Close()
 
-	go c.data_sender()
-	c.data_receiver()
+	// The data connection lives no longer than its session.
+	sender_done, rcv_done := make(chan bool), make(chan bool)
+	flushed := make(chan bool)
+	go (func() {
+		select {
+		case <-sess.done:
+		case <-c.quit:
+		case <-sender_done:
+		}
+		conn.Close()
+	})()
+	go (func() {
+		c.data_sender(conn, sess, flushed, rcv_done)
+		close(sender_done)
+	})()
+	c.data_receiver(conn, sess, flushed)
+	close(rcv_done)
+	conn.Close()
+	<-sender_done
 
 	return true
 }
 func (c *Client) data_worker() {
-	backoff := time.Duration(0)
-	for c.stop == false {
-		<-c.signal
-		if c.data_ready {
-			if c.data_worker_loop() {
-				backoff = 0
+	defer close(c.done_data)
+	attempt, delay := 0, time.Duration(0)
+	var sess *session
+	for {
+		// A data connection that fails while its session is still
+		// alive is retried; otherwise wait for the next session.
+		if sess == nil || sess.ended() {
+			select {
+			case sess = <-c.signal:
+			case <-c.quit:
+				return
 			}
 		}
-		if backoff > 0 {
-			rngM.Lock()
-			four_ms_jitter := 4096 - (int(rng.Int31()) % 8192)
-			rngM.Unlock()
-			jitter := time.Duration(four_ms_jitter) * time.Millisecond
-			time.Sleep(backoff + jitter)
-		} else {
-			backoff = 16 * time.Millisecond
+		if sess != nil && c.data_worker_loop(sess) {
+			attempt, delay = 0, 0
+			// Don't redial a connection closed by halting.
+			select {
+			case <-c.quit:
+				return
+			default:
+			}
+			continue
 		}
-		if backoff < time.Second {
-			backoff += (backoff >> 4)
+		// Either side failed to connect; pace the next attempt.
+		attempt++
+		var ok bool
+		if delay, ok = c.next_backoff(attempt, delay); !ok {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.quit:
+			return
 		}
 	}
-	close(c.done_data)
 }
 
 // A sample (and useful) Hook binding that allows for simple subscription.
@@ -1014,10 +1678,14 @@ type transientSubHooks struct {
 	MsgsC    chan *Message
 	ErrorsC  chan error
 	bindings []BindReq
+	bound    bool
+	warned   atomic.Bool
 }
 
 // NewTSHooks returns a simple hooks implementation that exposes
-// a MsgC channel of Messages and ErrorsC channel of errors.
+// a MsgC channel of Messages and ErrorsC channel of errors.  When
+// MsgsC is full, messages are dropped or wait according to the
+// Client's ReceivePolicy.
 func NewTSHooks() transientSubHooks {
 	return transientSubHooks{
 		MsgsC:   make(chan *Message, 10000),
@@ -1029,6 +1697,11 @@ func (h *transientSubHooks) AuthHook(c *Client, err error) {
 		h.ErrorsC <- err
 		return
 	}
+	// Once bound, a rebinding Client replays our bindings on reconnect.
+	if h.bound && c.rebind.Load() {
+		return
+	}
+	h.bound = true
 	for _, breq := range h.bindings {
 		c.Bind(&breq)
 	}
@@ -1043,7 +1716,7 @@ func (h *transientSubHooks) AddBinding(exchange, program string) {
 }
 func (h *transientSubHooks) BindHook(c *Client, breq *BindReq) {
 	if breq.OutRouteId == 0xffffffff {
-		h.ErrorsC <- fmt.Errorf("binding failure: %s, %s", breq.Exchange, breq.Program)
+		h.ErrorsC <- fmt.Errorf("%w: %s, %s", ErrBindFailed, breq.Exchange.ToString(), breq.Program)
 	}
 }
 func (h *transientSubHooks) UnbindHook(c *Client, breq *UnbindReq) {
@@ -1053,9 +1726,17 @@ func (h *transientSubHooks) DisconnectHook(c *Client) {
 func (h *transientSubHooks) ErrorLogHook(c *Client, err string) {
 	h.ErrorsC <- fmt.Errorf("%s", err)
 }
+func (h *transientSubHooks) ErrorHook(c *Client, err error) {
+	h.ErrorsC <- err
+}
 func (h *transientSubHooks) StatusHook(c *Client, stats map[string]uint32) {
 }
 func (h *transientSubHooks) MessageHook(c *Client, msg *Message) bool {
+	if action, ok := c.receive_dropping(); ok {
+		receive_drop(c, action, h.MsgsC, msg, (*Message).Release, &h.warned)
+		return true
+	}
 	h.MsgsC <- msg
+	c.receive_warn(&h.warned, len(h.MsgsC))
 	return true
 }
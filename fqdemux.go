@@ -0,0 +1,146 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// RouteMatcher may be implemented by a RouteProgram, as
+// *route.Program does, to evaluate it locally.  The Client uses it to
+// tell which of its bindings routed a message, so MayMatch must give
+// the same answer every time for the same message: rules the server
+// decides at random, such as sample, are to be counted as accepting
+// it.
+type RouteMatcher interface {
+	MayMatch(msg *Message) bool
+}
+
+// SubscribeBind is like Subscribe, binding req as BindContext does,
+// and likewise fails with ErrWouldDeadlock from hooks run on the
+// Client's command go routine.
+// Each message is delivered to the Subscriptions whose bindings
+// routed it, as told by req.Route if it is a RouteMatcher, or else by
+// the route pattern of req.Program, disregarding its filter rules.
+// Other Subscriptions matching the message receive a copy of it.  A
+// transient binding is replayed after every reconnect, whether or not
+// rebinding is enabled (see SetRebind).
+func (c *Client) SubscribeBind(ctx context.Context, req *BindReq) (*Subscription, error) {
+	return c.subscribe_bind(ctx, req, nil)
+}
+
+// SubscribeFunc is like SubscribeBind, but passes each message to
+// handler instead of delivering it on C.  handler is called from the
+// Client's go routines, one message at a time, and holds up the
+// receipt of further messages until it returns.
+func (c *Client) SubscribeFunc(ctx context.Context, req *BindReq, handler func(msg *Message)) (*Subscription, error) {
+	return c.subscribe_bind(ctx, req, handler)
+}
+
+// RouteId returns the route id of the Subscription's binding, which
+// changes when the binding is replayed after a reconnect.
+func (s *Subscription) RouteId() uint32 {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	return s.route
+}
+
+// BindingFor returns the binding, among those to be replayed on
+// reconnect (see Bindings), that routed msg, telling them apart as
+// SubscribeBind does.  It reports false if none did.  Only with
+// rebinding enabled (see SetRebind) are bindings other than those of
+// Subscriptions considered.
+func (c *Client) BindingFor(msg *Message) (BindReq, bool) {
+	for _, b := range c.Bindings() {
+		if b.Exchange != msg.Exchange {
+			continue
+		}
+		if match := route_matcher(&b); match == nil || match(msg) {
+			return b, true
+		}
+	}
+	return BindReq{}, false
+}
+
+// route_matcher returns a function telling whether req routed a
+// message, or nil if its program cannot be told apart from others on
+// the exchange.
+func route_matcher(req *BindReq) func(*Message) bool {
+	if m, ok := req.Route.(RouteMatcher); ok {
+		return m.MayMatch
+	}
+	kind, rest, ok := strings.Cut(strings.TrimSpace(req.Program), ":")
+	if !ok || (kind != "prefix" && kind != "exact") {
+		return nil
+	}
+	quoted, err := strconv.QuotedPrefix(strings.TrimSpace(rest))
+	if err != nil {
+		return nil
+	}
+	pattern, err := strconv.Unquote(quoted)
+	if err != nil {
+		return nil
+	}
+	if kind == "exact" {
+		return func(msg *Message) bool {
+			return string(msg.Route.Name[:msg.Route.Len]) == pattern
+		}
+	}
+	return func(msg *Message) bool {
+		return strings.HasPrefix(string(msg.Route.Name[:msg.Route.Len]), pattern)
+	}
+}
+
+// demux delivers msg to the Subscriptions whose bindings routed it.
+// It reports whether there were any, and false for ok if the data
+// connection is done with.
+func (c *Client) demux(msg *Message, sess *session, flushed chan bool) (found, ok bool) {
+	var subs []*Subscription
+	for _, s := range c.subscriptions() {
+		if s.exchange == msg.Exchange && (s.match == nil || s.match(msg)) {
+			subs = append(subs, s)
+		}
+	}
+	if len(subs) == 0 {
+		return false, true
+	}
+	// Copy first: the first Subscription may release msg as soon as
+	// it has it.
+	msgs := make([]*Message, len(subs))
+	msgs[0] = msg
+	for i := 1; i < len(subs); i++ {
+		msgs[i] = msg.clone()
+	}
+	for i, s := range subs {
+		if !s.deliver(msgs[i], sess, flushed) {
+			for _, m := range msgs[i+1:] {
+				m.Release()
+			}
+			return true, false
+		}
+	}
+	return true, true
+}
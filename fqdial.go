@@ -0,0 +1,474 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialOptions collects the settings applied by Options before
+// they are validated and transferred to a Client.
+type dialOptions struct {
+	user, pass        string
+	queue, queue_type string
+	backlog           int
+	hb_interval       time.Duration
+	hb_max_age        time.Duration
+	dial_timeout      time.Duration
+	hooks             Hooks
+	sync_hooks        bool
+	overflow          *OverflowPolicy
+	receive_policy    *ReceivePolicy
+	peermode          bool
+	no_rebind         bool
+	backoff           BackoffPolicy
+	servers           []string
+	selection         ServerSelection
+	failover_cooldown time.Duration
+	resolve_interval  time.Duration
+	tls_config        *tls.Config
+	dialer            Dialer
+	batch_size        int
+	batch_linger      time.Duration
+	max_payload       int
+	max_hops          int
+	pub_limits        *publish_limits
+	spool_dir         string
+	spool_opts        SpoolOptions
+}
+
+// An Option configures a Client created by Dial.
+type Option func(*dialOptions) error
+
+// WithCredentials sets the user and password used to authenticate.
+// It is required.
+func WithCredentials(user, pass string) Option {
+	return func(o *dialOptions) error {
+		if user == "" {
+			return fmt.Errorf("user must not be empty")
+		}
+		if strings.ContainsRune(user, '/') {
+			return fmt.Errorf("user must not contain '/'")
+		}
+		o.user, o.pass = user, pass
+		return nil
+	}
+}
+
+// WithQueue sets the name and type of the queue to bind messages to.
+// An empty queueType selects FQ_DEFAULT_QUEUE_TYPE.  Without this
+// option a unique transient queue name is generated.
+func WithQueue(name, queueType string) Option {
+	return func(o *dialOptions) error {
+		if name == "" {
+			return fmt.Errorf("queue name must not be empty")
+		}
+		if strings.ContainsRune(name, 0) || strings.ContainsRune(queueType, 0) {
+			return fmt.Errorf("queue name and type must not contain NUL")
+		}
+		o.queue, o.queue_type = name, queueType
+		return nil
+	}
+}
+
+// WithBacklog sets the capacity of the internal publish and receive
+// queues (see SetBacklog).
+func WithBacklog(n int) Option {
+	return func(o *dialOptions) error {
+		if n <= 0 {
+			return fmt.Errorf("backlog must be positive: %d", n)
+		}
+		o.backlog = n
+		return nil
+	}
+}
+
+// WithHeartBeat sets the heartbeat interval (see SetHeartBeat).  The
+// interval may not exceed one second.
+func WithHeartBeat(interval time.Duration) Option {
+	return func(o *dialOptions) error {
+		if interval <= 0 || interval > time.Second {
+			return fmt.Errorf("heartbeat must be in (0, 1s]: %v", interval)
+		}
+		o.hb_interval = interval
+		return nil
+	}
+}
+
+// WithHeartBeatMaxAge sets the max allowable silence before the
+// connection is considered dead (see SetHeartBeatMaxAge).  It
+// defaults to three times the heartbeat interval and may not be
+// shorter than the interval.
+func WithHeartBeatMaxAge(age time.Duration) Option {
+	return func(o *dialOptions) error {
+		if age <= 0 {
+			return fmt.Errorf("heartbeat max age must be positive: %v", age)
+		}
+		o.hb_max_age = age
+		return nil
+	}
+}
+
+// WithDialTimeout sets the timeout for establishing each connection
+// to the server.  The default is two seconds.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *dialOptions) error {
+		if timeout <= 0 {
+			return fmt.Errorf("dial timeout must be positive: %v", timeout)
+		}
+		o.dial_timeout = timeout
+		return nil
+	}
+}
+
+// WithHooks sets the Hooks driving the session (see SetHooks).
+func WithHooks(hooks Hooks) Option {
+	return func(o *dialOptions) error {
+		if hooks == nil {
+			return fmt.Errorf("hooks must not be nil")
+		}
+		o.hooks = hooks
+		return nil
+	}
+}
+
+// WithSynchronous causes hooks to be invoked only from within Receive
+// (see SetSynchronous).  It requires WithHooks.
+func WithSynchronous() Option {
+	return func(o *dialOptions) error {
+		o.sync_hooks = true
+		return nil
+	}
+}
+
+// WithNonBlocking causes Publish to return false rather than block
+// when the backlog is full (see SetNonBlocking).
+func WithNonBlocking() Option {
+	return func(o *dialOptions) error {
+		o.overflow = &OverflowPolicy{Action: OverflowDropNewest}
+		return nil
+	}
+}
+
+// WithPeerMode connects as an fq peer rather than a regular client
+// (see NewPeer).
+func WithPeerMode() Option {
+	return func(o *dialOptions) error {
+		o.peermode = true
+		return nil
+	}
+}
+
+// WithBackoff sets the policy pacing reconnection attempts (see
+// SetBackoff).
+func WithBackoff(policy BackoffPolicy) Option {
+	return func(o *dialOptions) error {
+		if policy == nil {
+			return fmt.Errorf("backoff policy must not be nil")
+		}
+		o.backoff = policy
+		return nil
+	}
+}
+
+// WithServers adds servers to fail over to after the one given to
+// Dial (see SetServers).
+func WithServers(addrs ...string) Option {
+	return func(o *dialOptions) error {
+		o.servers = append(o.servers, addrs...)
+		return nil
+	}
+}
+
+// WithServerSelection sets how the Client chooses among its servers
+// (see SetServerSelection).
+func WithServerSelection(sel ServerSelection) Option {
+	return func(o *dialOptions) error {
+		if sel < RotateServers || sel > HealthiestServer {
+			return fmt.Errorf("unknown server selection %d", sel)
+		}
+		o.selection = sel
+		return nil
+	}
+}
+
+// WithFailoverCooldown sets how long a failed server is passed over
+// by StickyPrimary (see SetFailoverCooldown).
+func WithFailoverCooldown(cooldown time.Duration) Option {
+	return func(o *dialOptions) error {
+		if cooldown <= 0 {
+			return fmt.Errorf("failover cooldown must be positive: %v", cooldown)
+		}
+		o.failover_cooldown = cooldown
+		return nil
+	}
+}
+
+// WithResolveInterval sets how often server names are looked up
+// again (see SetResolveInterval).
+func WithResolveInterval(interval time.Duration) Option {
+	return func(o *dialOptions) error {
+		if interval <= 0 {
+			return fmt.Errorf("resolve interval must be positive: %v", interval)
+		}
+		o.resolve_interval = interval
+		return nil
+	}
+}
+
+// WithTLS makes the Client connect to the server over TLS (see
+// SetTLSConfig).
+func WithTLS(config *tls.Config) Option {
+	return func(o *dialOptions) error {
+		if config == nil {
+			return fmt.Errorf("tls config must not be nil")
+		}
+		o.tls_config = config
+		return nil
+	}
+}
+
+// WithDialer sets the Dialer used to reach the server (see
+// SetDialer).
+func WithDialer(d Dialer) Option {
+	return func(o *dialOptions) error {
+		if d == nil {
+			return fmt.Errorf("dialer must not be nil")
+		}
+		o.dialer = d
+		return nil
+	}
+}
+
+// WithBatching sets how published messages are batched into writes
+// (see SetBatching).
+func WithBatching(maxBytes int, linger time.Duration) Option {
+	return func(o *dialOptions) error {
+		if maxBytes <= 0 {
+			return fmt.Errorf("batch size must be positive: %d", maxBytes)
+		}
+		if linger < 0 {
+			return fmt.Errorf("linger must not be negative: %v", linger)
+		}
+		o.batch_size, o.batch_linger = maxBytes, linger
+		return nil
+	}
+}
+
+// WithReceiveLimits bounds the messages accepted from the server (see
+// SetReceiveLimits).
+func WithReceiveLimits(maxPayload, maxHops int) Option {
+	return func(o *dialOptions) error {
+		if maxPayload < 0 || maxHops < 0 {
+			return fmt.Errorf("receive limits must not be negative: %d, %d", maxPayload, maxHops)
+		}
+		o.max_payload, o.max_hops = maxPayload, maxHops
+		return nil
+	}
+}
+
+// WithPublishLimits bounds what the Client sends (see
+// SetPublishLimits).
+func WithPublishLimits(maxPayload, maxNameLen, maxProgramLen int) Option {
+	return func(o *dialOptions) error {
+		if maxPayload < 0 || maxNameLen < 0 || maxProgramLen < 0 {
+			return fmt.Errorf("publish limits must not be negative: %d, %d, %d",
+				maxPayload, maxNameLen, maxProgramLen)
+		}
+		o.pub_limits = &publish_limits{maxPayload, maxNameLen, maxProgramLen}
+		return nil
+	}
+}
+
+// WithSpool makes the Client publish through a spool kept in dir (see
+// SetSpool).
+func WithSpool(dir string, opts SpoolOptions) Option {
+	return func(o *dialOptions) error {
+		if dir == "" {
+			return fmt.Errorf("spool directory must not be empty")
+		}
+		if opts.SegmentSize < 0 || opts.MaxSize < 0 || opts.SyncInterval < 0 {
+			return fmt.Errorf("spool options must not be negative")
+		}
+		o.spool_dir, o.spool_opts = dir, opts
+		return nil
+	}
+}
+
+// WithOverflowPolicy sets what Publish does when the backlog is full
+// (see SetOverflowPolicy).
+func WithOverflowPolicy(p OverflowPolicy) Option {
+	return func(o *dialOptions) error {
+		if err := p.check(); err != nil {
+			return err
+		}
+		o.overflow = &p
+		return nil
+	}
+}
+
+// WithReceivePolicy sets what the Client does with received messages
+// when the receive backlog is full (see SetReceivePolicy).
+func WithReceivePolicy(p ReceivePolicy) Option {
+	return func(o *dialOptions) error {
+		if err := p.check(); err != nil {
+			return err
+		}
+		o.receive_policy = &p
+		return nil
+	}
+}
+
+// WithoutRebind disables replaying transient bindings after a
+// reconnect (see SetRebind).
+func WithoutRebind() Option {
+	return func(o *dialOptions) error {
+		o.no_rebind = true
+		return nil
+	}
+}
+
+func (o *dialOptions) validate() error {
+	if o.user == "" {
+		return fmt.Errorf("WithCredentials is required")
+	}
+	if o.sync_hooks && o.hooks == nil {
+		return fmt.Errorf("WithSynchronous requires WithHooks")
+	}
+	if o.hb_max_age > 0 {
+		interval := o.hb_interval
+		if interval == 0 {
+			interval = time.Second
+		}
+		if o.hb_max_age < interval {
+			return fmt.Errorf("heartbeat max age %v shorter than interval %v",
+				o.hb_max_age, interval)
+		}
+	}
+	return nil
+}
+
+// Dial creates a Client configured by opts and connects it to the fq
+// server at addr, given as "host:port" or just "host" to use
+// FQ_DEFAULT_PORT.  All options are validated before any connection
+// is attempted; invalid values or combinations are returned as an
+// error.  As with Connect, the connection is established (and
+// reestablished) in the background.
+func Dial(addr string, opts ...Option) (*Client, error) {
+	host, port, err := split_addr(addr)
+	if err != nil {
+		return nil, err
+	}
+	o := &dialOptions{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	c := internalClient(o.peermode)
+	if o.backlog > 0 {
+		c.qmaxlen = o.backlog
+	}
+	if o.hb_interval > 0 {
+		c.SetHeartBeat(o.hb_interval)
+	}
+	if o.hb_max_age > 0 {
+		c.SetHeartBeatMaxAge(o.hb_max_age)
+	}
+	if o.dial_timeout > 0 {
+		c.dial_timeout = o.dial_timeout
+	}
+	c.hooks = o.hooks
+	c.backoff = o.backoff
+	c.selection = o.selection
+	if o.failover_cooldown > 0 {
+		c.failover_cooldown = o.failover_cooldown
+	}
+	if o.resolve_interval > 0 {
+		c.resolve_interval = o.resolve_interval
+	}
+	c.tls_config = o.tls_config
+	c.dialer = o.dialer
+	if o.batch_size > 0 {
+		c.batch_size, c.batch_linger = o.batch_size, o.batch_linger
+	}
+	c.max_payload, c.max_hops = o.max_payload, o.max_hops
+	if l := o.pub_limits; l != nil {
+		c.SetPublishLimits(l.payload, l.name, l.program)
+	}
+	if len(o.servers) > 0 || is_srv(addr) {
+		if err := c.SetServers(append([]string{addr}, o.servers...)...); err != nil {
+			return nil, err
+		}
+	}
+	c.sync_hooks.Store(o.sync_hooks)
+	if o.overflow != nil {
+		c.overflow_policy.Store(o.overflow)
+	}
+	if o.receive_policy != nil {
+		c.receive_policy.Store(o.receive_policy)
+	}
+	c.rebind.Store(!o.no_rebind)
+	if o.spool_dir != "" {
+		if err := c.SetSpool(o.spool_dir, o.spool_opts); err != nil {
+			return nil, err
+		}
+	}
+	c.init_creds(host, port, o.user, o.queue, o.queue_type, o.pass)
+
+	if err := c.Connect(); err != nil {
+		if c.spool != nil {
+			c.spool.close()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func split_addr(addr string) (string, uint16, error) {
+	host, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		if !strings.Contains(err.Error(), "missing port") {
+			return "", 0, err
+		}
+		host, portstr = strings.Trim(addr, "[]"), strconv.Itoa(FQ_DEFAULT_PORT)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("address %q: missing host", addr)
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("address %q: invalid port", addr)
+	}
+	return host, uint16(port), nil
+}
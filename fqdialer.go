@@ -0,0 +1,90 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer establishes the Client's command and data connections.  It
+// is satisfied by *net.Dialer and by the dialers of
+// golang.org/x/net/proxy, so SOCKS5 proxies can be used directly.
+// Dial is called with network "tcp" and the "host:port" of the
+// server.  If the Dialer also implements ContextDialer, DialContext
+// is used instead, so that the dial timeout and Close can interrupt
+// it.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// ContextDialer is the optional context aware form of Dialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialerFunc adapts a function to a Dialer, e.g. to hand out one end
+// of a net.Pipe.
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f DialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f DialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// UnixDialer returns a Dialer connecting to the unix-domain socket
+// at path whatever server address it is asked for.
+func UnixDialer(path string) Dialer {
+	return DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	})
+}
+
+// SetDialer sets the Dialer used for both the command and data
+// connections; nil restores a plain net.Dialer.  With a Dialer set,
+// server host names are passed to it unresolved (SRV records are
+// still looked up), leaving resolution to a proxy.  TLS, if
+// configured, runs over the connections it returns.
+func (c *Client) SetDialer(d Dialer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dialer = d
+}
+
+// dial_with connects to addr using d, or a net.Dialer if d is nil.
+func dial_with(ctx context.Context, d Dialer, addr string) (net.Conn, error) {
+	switch d := d.(type) {
+	case nil:
+		var nd net.Dialer
+		return nd.DialContext(ctx, "tcp", addr)
+	case ContextDialer:
+		return d.DialContext(ctx, "tcp", addr)
+	default:
+		return d.Dial("tcp", addr)
+	}
+}
@@ -0,0 +1,119 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors reported by the Client.  They may be wrapped with additional
+// context, so they should be tested for with errors.Is.
+var (
+	// ErrHeartbeatTimeout is reported when the server has been silent
+	// for longer than the heartbeat max age.  The connection is torn
+	// down and reestablished.
+	ErrHeartbeatTimeout = errors.New("dead: missing heartbeat")
+
+	// ErrAuthFailed is reported when the server rejects the
+	// credentials supplied via Creds.
+	ErrAuthFailed = errors.New("authentication failed")
+
+	// ErrBindFailed is reported when the server refuses a binding,
+	// answering with FQ_BIND_ILLEGAL.
+	ErrBindFailed = errors.New("bind failed")
+
+	// ErrUnbindFailed is reported when the server reports an unbind
+	// as unsuccessful.
+	ErrUnbindFailed = errors.New("unbind failed")
+
+	// ErrNotConnected is reported when a command cannot be completed
+	// because the Client is not (or no longer) connected.
+	ErrNotConnected = errors.New("not connected")
+
+	// ErrGaveUp is reported when the BackoffPolicy gives up on
+	// reconnecting.  The Client stops as if Close had been called,
+	// though queued messages remain for Close to return.
+	ErrGaveUp = errors.New("gave up reconnecting")
+
+	// ErrClosed is reported when publishing on a Client that has
+	// been closed (or has given up reconnecting).
+	ErrClosed = errors.New("client closed")
+
+	// ErrBacklogFull is reported, possibly wrapped, for a message the
+	// OverflowPolicy refuses or drops while the publish queue is full.
+	ErrBacklogFull = errors.New("publish backlog full")
+
+	// ErrSpoolFull is reported when publishing a message that would
+	// take the spool beyond its MaxSize.
+	ErrSpoolFull = errors.New("spool full")
+
+	// ErrWouldDeadlock is returned by BindContext, UnbindContext and
+	// StatusContext when called from a hook running on the go routine
+	// that would have to carry out the request: AuthHook, BindHook,
+	// UnbindHook, StatusHook, DisconnectHook or the error hooks, unless
+	// in synchronous mode.  Use Bind, Unbind or Status there instead.
+	ErrWouldDeadlock = errors.New("blocking call from a hook would deadlock")
+)
+
+// ProtocolViolationError is reported when the server sends a command
+// the Client did not expect.  The connection is torn down and
+// reestablished.
+type ProtocolViolationError struct {
+	// Command is the unexpected command code read from the server.
+	Command uint16
+	// Expected describes what the Client was waiting for, if anything.
+	Expected string
+}
+
+func (e *ProtocolViolationError) Error() string {
+	if e.Expected != "" {
+		return fmt.Sprintf("protocol violation: 0x%04x (exp %s)", e.Command, e.Expected)
+	}
+	return fmt.Sprintf("protocol violation: 0x%04x", e.Command)
+}
+
+// LimitError is returned when a message or binding exceeds the limits
+// set by SetPublishLimits, or a name exceeds FQ_MAX_RK_LEN.  Nothing
+// has been sent.
+type LimitError struct {
+	// What names the limit: "payload", "exchange", "route", "name" or
+	// "program".
+	What string
+	// Size is the length in bytes that was refused.
+	Size  int
+	Limit int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s of %d bytes exceeds limit of %d", e.What, e.Size, e.Limit)
+}
+
+// ErrorHooks may optionally be implemented by a Hooks implementation
+// to receive errors as values.  When implemented, ErrorHook is invoked
+// in place of ErrorLogHook, allowing the use of errors.Is and errors.As
+// against the sentinel and typed errors of this package.
+type ErrorHooks interface {
+	ErrorHook(c *Client, err error)
+}
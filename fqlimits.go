@@ -0,0 +1,133 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"github.com/postwait/gofq/wire"
+	"math"
+)
+
+// SetReceiveLimits bounds the messages the Client accepts from the
+// server: payloads of at most maxPayload bytes (wire.DefaultMaxPayload
+// if zero) that have passed through at most maxHops servers
+// (wire.MaxHops if zero).  A message exceeding them is reported as a
+// *wire.LimitError and the data connection is reestablished, losing
+// the message, rather than the Client allocating whatever the server
+// claims.  Changes take effect on the next data connection.
+func (c *Client) SetReceiveLimits(maxPayload, maxHops int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max_payload, c.max_hops = max(maxPayload, 0), max(maxHops, 0)
+}
+
+// Protocol limits on what the Client publishes.
+const (
+	max_PAYLOAD_LEN = min(0xffffffff, math.MaxInt)
+	max_PROGRAM_LEN = 0xffff
+)
+
+// publish_limits are the bounds set by SetPublishLimits.
+type publish_limits struct {
+	payload, name, program int
+}
+
+// SetPublishLimits bounds what the Client sends: message payloads of
+// at most maxPayload bytes (wire.DefaultMaxPayload if zero), exchange
+// and route names of at most maxNameLen bytes (FQ_MAX_RK_LEN if zero)
+// and binding programs of at most maxProgramLen bytes (the protocol's
+// 65535 if zero).  Limits beyond what the protocol can carry are
+// lowered to it.  Publish, TryPublish, PublishAsync, Bind and
+// BindContext refuse anything exceeding them with a *LimitError,
+// before it is queued.
+func (c *Client) SetPublishLimits(maxPayload, maxNameLen, maxProgramLen int) {
+	l := &publish_limits{
+		payload: or_limit(maxPayload, wire.DefaultMaxPayload, max_PAYLOAD_LEN),
+		name:    or_limit(maxNameLen, FQ_MAX_RK_LEN, FQ_MAX_RK_LEN),
+		program: or_limit(maxProgramLen, max_PROGRAM_LEN, max_PROGRAM_LEN),
+	}
+	c.pub_limits.Store(l)
+}
+
+func or_limit(limit, def, most int) int {
+	if limit <= 0 {
+		return def
+	}
+	return min(limit, most)
+}
+
+// NewRk is like Rk, but returns a *LimitError rather than truncating
+// a name longer than FQ_MAX_RK_LEN.
+func NewRk(str string) (fq_rk, error) {
+	return checked_rk("name", str)
+}
+
+func checked_rk(what, str string) (fq_rk, error) {
+	rk := Rk(str)
+	if len(str) > FQ_MAX_RK_LEN {
+		return rk, &LimitError{What: what, Size: len(str), Limit: FQ_MAX_RK_LEN}
+	}
+	return rk, nil
+}
+
+func (c *Client) publish_limits() *publish_limits {
+	if l := c.pub_limits.Load(); l != nil {
+		return l
+	}
+	return &default_limits
+}
+
+var default_limits = publish_limits{
+	payload: wire.DefaultMaxPayload,
+	name:    FQ_MAX_RK_LEN,
+	program: max_PROGRAM_LEN,
+}
+
+// check_message returns a *LimitError if msg may not be published.
+func (c *Client) check_message(msg *Message) error {
+	if msg.truncated != nil {
+		return msg.truncated
+	}
+	l := c.publish_limits()
+	switch {
+	case int(msg.Exchange.Len) > l.name:
+		return &LimitError{What: "exchange", Size: int(msg.Exchange.Len), Limit: l.name}
+	case int(msg.Route.Len) > l.name:
+		return &LimitError{What: "route", Size: int(msg.Route.Len), Limit: l.name}
+	case len(msg.Payload) > l.payload:
+		return &LimitError{What: "payload", Size: len(msg.Payload), Limit: l.payload}
+	}
+	return nil
+}
+
+// check_bind returns a *LimitError if req may not be sent.
+func (c *Client) check_bind(req *BindReq) error {
+	l := c.publish_limits()
+	switch {
+	case int(req.Exchange.Len) > l.name:
+		return &LimitError{What: "exchange", Size: int(req.Exchange.Len), Limit: l.name}
+	case len(req.Program) > l.program:
+		return &LimitError{What: "program", Size: len(req.Program), Limit: l.program}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowAction is what Publish does with a message that finds the
+// backlog (see SetBacklog) full.
+type OverflowAction int
+
+const (
+	// OverflowBlock waits for room.  It is the default.
+	OverflowBlock OverflowAction = iota
+	// OverflowDropNewest refuses the message, as SetNonBlocking does.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued message to make
+	// room, keeping the backlog a ring of the freshest messages.
+	OverflowDropOldest
+	// OverflowBlockTimeout waits up to the policy's Timeout for
+	// room, then refuses the message.
+	OverflowBlockTimeout
+	// OverflowSample queues only a fraction of messages once the
+	// backlog fills beyond a threshold, and refuses them when it is
+	// full.
+	OverflowSample
+	// OverflowSpill hands the message to the policy's Spill function
+	// instead of queueing it.
+	OverflowSpill
+)
+
+// OverflowPolicy configures what Publish does when the backlog is
+// full.  Messages it does not queue are refused with an error
+// wrapping ErrBacklogFull: Publish returns false and PublishAsync
+// delivers the error, as does the PublishAsync of a message dropped
+// by OverflowDropOldest.  Each such message is counted in the
+// Client's OverflowStats.
+type OverflowPolicy struct {
+	Action OverflowAction
+	// Timeout is how long OverflowBlockTimeout waits.
+	Timeout time.Duration
+	// SampleAbove is the fraction of the backlog beyond which
+	// OverflowSample queues only SampleRate of the messages
+	// published.  It defaults to 0.5, and SampleRate to 0.1.
+	SampleAbove, SampleRate float64
+	// Spill is called by Publish with each message OverflowSpill
+	// does not queue.
+	Spill func(msg *Message)
+}
+
+// OverflowStats counts the messages refused or dropped by the
+// OverflowPolicy, by how.
+type OverflowStats struct {
+	DroppedNewest uint64
+	DroppedOldest uint64
+	TimedOut      uint64
+	SampledOut    uint64
+	Spilled       uint64
+}
+
+// overflow_counters are the OverflowStats as they are counted.
+type overflow_counters struct {
+	dropped_newest, dropped_oldest atomic.Uint64
+	timed_out, sampled_out         atomic.Uint64
+	spilled                        atomic.Uint64
+}
+
+// SetOverflowPolicy sets what Publish does when the backlog is full.
+// It has no effect with a spool (see SetSpool), which has a size
+// limit of its own.
+func (c *Client) SetOverflowPolicy(p OverflowPolicy) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	c.overflow_policy.Store(&p)
+	return nil
+}
+
+// check validates p, filling in its defaults.
+func (p *OverflowPolicy) check() error {
+	switch p.Action {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	case OverflowBlockTimeout:
+		if p.Timeout <= 0 {
+			return fmt.Errorf("overflow timeout must be positive: %v", p.Timeout)
+		}
+	case OverflowSample:
+		if p.SampleAbove == 0 {
+			p.SampleAbove = 0.5
+		}
+		if p.SampleRate == 0 {
+			p.SampleRate = 0.1
+		}
+		if p.SampleAbove < 0 || p.SampleAbove > 1 || p.SampleRate < 0 || p.SampleRate > 1 {
+			return fmt.Errorf("overflow sampling must be between 0 and 1: %v, %v",
+				p.SampleAbove, p.SampleRate)
+		}
+	case OverflowSpill:
+		if p.Spill == nil {
+			return fmt.Errorf("overflow spill function must not be nil")
+		}
+	default:
+		return fmt.Errorf("unknown overflow action %d", p.Action)
+	}
+	return nil
+}
+
+// OverflowStats returns how many messages the OverflowPolicy has
+// refused or dropped.
+func (c *Client) OverflowStats() OverflowStats {
+	return OverflowStats{
+		DroppedNewest: c.overflow_stats.dropped_newest.Load(),
+		DroppedOldest: c.overflow_stats.dropped_oldest.Load(),
+		TimedOut:      c.overflow_stats.timed_out.Load(),
+		SampledOut:    c.overflow_stats.sampled_out.Load(),
+		Spilled:       c.overflow_stats.spilled.Load(),
+	}
+}
+
+// overflow queues m according to a policy other than OverflowBlock.
+// The caller holds pub_mu.
+func (c *Client) overflow(p *OverflowPolicy, m *frontMessage) error {
+	stats := &c.overflow_stats
+	if p.Action == OverflowSample && float64(len(c.q)) >= p.SampleAbove*float64(cap(c.q)) {
+		rngM.Lock()
+		keep := rng.Float64() < p.SampleRate
+		rngM.Unlock()
+		if !keep {
+			stats.sampled_out.Add(1)
+			return fmt.Errorf("%w: sampled out", ErrBacklogFull)
+		}
+	}
+	select {
+	case c.q <- m:
+		return nil
+	default:
+	}
+	switch p.Action {
+	case OverflowDropOldest:
+		// Others may be taking from or adding to the queue too, so
+		// keep going until there is room for m.
+		for cap(c.q) > 0 {
+			select {
+			case old := <-c.q:
+				stats.dropped_oldest.Add(1)
+				old.confirm(fmt.Errorf("%w: dropped for a newer message", ErrBacklogFull))
+			default:
+			}
+			select {
+			case c.q <- m:
+				return nil
+			default:
+			}
+		}
+	case OverflowBlockTimeout:
+		t := time.NewTimer(p.Timeout)
+		defer t.Stop()
+		select {
+		case c.q <- m:
+			return nil
+		case <-t.C:
+			stats.timed_out.Add(1)
+			return fmt.Errorf("%w: timed out", ErrBacklogFull)
+		case <-c.closing:
+			return ErrClosed
+		case <-c.quit:
+			return ErrClosed
+		}
+	case OverflowSpill:
+		stats.spilled.Add(1)
+		p.Spill(m.msg)
+		return fmt.Errorf("%w: spilled", ErrBacklogFull)
+	}
+	stats.dropped_newest.Add(1)
+	return ErrBacklogFull
+}
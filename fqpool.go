@@ -0,0 +1,71 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import "sync"
+
+// max_pooled_payload bounds the payload buffer a released Message keeps
+// for reuse, so that one large message does not pin its memory.
+const max_pooled_payload = 64 * 1024
+
+var (
+	// msg_pool recycles received Messages, together with their
+	// payload and hop buffers, through Release.
+	msg_pool = sync.Pool{New: func() any { return &Message{pooled: true} }}
+	// back_pool recycles the envelopes carrying received messages to
+	// Receive.
+	back_pool = sync.Pool{New: func() any { return &backMessage{} }}
+)
+
+func new_message() *Message {
+	return msg_pool.Get().(*Message)
+}
+
+// clone returns a copy of m, recycled like a received Message.
+func (m *Message) clone() *Message {
+	cp := new_message()
+	payload := append(cp.Payload[:0], m.Payload...)
+	hops := append(cp.Hops[:0], m.Hops...)
+	*cp = *m
+	cp.Payload, cp.Hops, cp.pooled = payload, hops, true
+	return cp
+}
+
+// Release recycles a Message returned by Receive or passed to
+// MessageHook, so that its memory can hold a later message.  It is
+// optional: unreleased Messages are garbage collected as usual.  After
+// Release neither the Message nor its Payload may be used, and Release
+// must be called at most once.  It does nothing for Messages created
+// by NewMessage.
+func (m *Message) Release() {
+	if m == nil || !m.pooled {
+		return
+	}
+	payload, hops := m.Payload[:0], m.Hops[:0]
+	if cap(payload) > max_pooled_payload {
+		payload = nil
+	}
+	*m = Message{Payload: payload, Hops: hops, pooled: true}
+	msg_pool.Put(m)
+}
@@ -0,0 +1,212 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import "fmt"
+
+// RebindHooks may be implemented by Hooks to be told when a binding
+// has been replayed after a reconnect.  req carries the new route id
+// in OutRouteId; oldRouteId is the id it replaces.  A binding made
+// several times is replayed once, and RebindHook is called for each
+// of its old route ids.  If the Hooks do not implement RebindHooks,
+// BindHook is called with req instead, once.
+type RebindHooks interface {
+	RebindHook(c *Client, req *BindReq, oldRouteId uint32)
+}
+
+// SetRebind controls whether transient bindings are replayed after
+// a reconnect.  It is enabled by default: every successful transient
+// Bind is remembered, until a successful Unbind of its route, and
+// requested again each time the Client reauthenticates.  Binding the
+// same exchange, flags and program more than once is counted, not
+// replayed twice; the binding is replayed until each of its routes
+// has been unbound, and then under a single new route id.  Hooks that
+// reissue their bindings from AuthHook should bind only on the first
+// successful authentication, or disable rebinding.  Permanent
+// bindings (FQ_BIND_PERM) survive on the server and are never
+// replayed.  Subscriptions are replayed either way.
+func (c *Client) SetRebind(enabled bool) {
+	c.rebind.Store(enabled)
+}
+
+// binding is a tracked binding.  routes holds the route ids of every
+// bind it stands for, OutRouteId being one of them.
+type binding struct {
+	BindReq
+	routes []uint32
+	// keep marks the binding of a Subscription, which is tracked on
+	// its own and replayed even with rebinding disabled.
+	keep bool
+}
+
+// Bindings returns the transient bindings that will be replayed on
+// the next reconnect, with their current route ids.
+func (c *Client) Bindings() []BindReq {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bindings := make([]BindReq, len(c.bindings))
+	for i, b := range c.bindings {
+		bindings[i] = b.BindReq
+	}
+	return bindings
+}
+
+// track updates the bindings to be replayed with the outcome of a
+// completed bind or unbind.  It is called before the outcome is
+// dispatched.
+func (c *Client) track(cmd *fq_cmd_instr) {
+	switch cmd.cmd {
+	case fq_PROTO_BINDREQ:
+		req := cmd.data.bind
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if b := cmd.rebind; b != nil {
+			cmd.old_routes = b.routes
+			i := c.binding_index(b)
+			if i < 0 {
+				// unbound while the replay was in flight
+				return
+			}
+			if req.OutRouteId == FQ_BIND_ILLEGAL {
+				c.bindings = append(c.bindings[:i], c.bindings[i+1:]...)
+				for _, old := range cmd.old_routes {
+					c.resubscribe(req.Exchange, old, req.OutRouteId,
+						fmt.Errorf("%w: %s, %s", ErrBindFailed, req.Exchange.ToString(), req.Program))
+				}
+				return
+			}
+			for _, old := range cmd.old_routes {
+				c.resubscribe(req.Exchange, old, req.OutRouteId, nil)
+			}
+			b.OutRouteId = req.OutRouteId
+			b.routes = []uint32{req.OutRouteId}
+			return
+		}
+		if req.OutRouteId == FQ_BIND_ILLEGAL || req.Flags&FQ_BIND_PERM == FQ_BIND_PERM ||
+			(!c.rebind.Load() && !cmd.keep) {
+			return
+		}
+		if !cmd.keep {
+			if b := c.tracked(req); b != nil {
+				b.routes = append(b.routes, req.OutRouteId)
+				return
+			}
+		}
+		c.bindings = append(c.bindings, &binding{
+			BindReq: *req,
+			routes:  []uint32{req.OutRouteId},
+			keep:    cmd.keep,
+		})
+	case fq_PROTO_UNBINDREQ:
+		req := cmd.data.unbind
+		if req.OutSuccess == 0 {
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.untrack(req.Exchange, req.RouteId)
+	}
+}
+
+// untrack stops replaying route on exchange, and with it the binding
+// once none of its routes remain.  The caller holds c.mu.
+func (c *Client) untrack(exchange fq_rk, route uint32) {
+	for i, b := range c.bindings {
+		if b.Exchange != exchange {
+			continue
+		}
+		for j, r := range b.routes {
+			if r != route {
+				continue
+			}
+			b.routes = append(b.routes[:j:j], b.routes[j+1:]...)
+			if len(b.routes) == 0 {
+				c.bindings = append(c.bindings[:i], c.bindings[i+1:]...)
+			} else if b.OutRouteId == route {
+				b.OutRouteId = b.routes[0]
+			}
+			return
+		}
+	}
+}
+
+// tracked returns the binding like req that a duplicate of req
+// should be counted against, or nil.  The caller holds c.mu.
+func (c *Client) tracked(req *BindReq) *binding {
+	for _, b := range c.bindings {
+		if !b.keep && b.Exchange == req.Exchange && b.Flags == req.Flags && b.Program == req.Program {
+			return b
+		}
+	}
+	return nil
+}
+
+func (c *Client) binding_index(b *binding) int {
+	for i, tb := range c.bindings {
+		if tb == b {
+			return i
+		}
+	}
+	return -1
+}
+
+// replay returns the bind requests needed to restore the tracked
+// bindings on a new session, or nil if there are none.  With
+// rebinding disabled, only the bindings of Subscriptions are
+// restored.
+func (c *Client) replay() chan *fq_cmd_instr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var bindings []*binding
+	for _, b := range c.bindings {
+		if c.rebind.Load() || b.keep {
+			bindings = append(bindings, b)
+		}
+	}
+	if len(bindings) == 0 {
+		return nil
+	}
+	replayq := make(chan *fq_cmd_instr, len(bindings))
+	for _, b := range bindings {
+		e := &fq_cmd_instr{cmd: fq_PROTO_BINDREQ, rebind: b}
+		req := b.BindReq
+		e.data.bind = &req
+		replayq <- e
+	}
+	close(replayq)
+	return replayq
+}
+
+// rebound reports a successfully replayed binding to the hooks.
+func (c *Client) rebound(hooks Hooks, e *fq_cmd_instr) {
+	req := e.data.bind
+	rh, ok := hooks.(RebindHooks)
+	if !ok {
+		hooks.BindHook(c, req)
+		return
+	}
+	for _, old := range e.old_routes {
+		rh.RebindHook(c, req, old)
+	}
+}
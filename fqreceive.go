@@ -0,0 +1,154 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ReceivePolicy configures what the Client does with a received
+// message when the backlog waiting for Receive (see SetBacklog), or
+// the MsgsC channel of the NewTSHooks hooks, is full.
+type ReceivePolicy struct {
+	// Action is one of OverflowBlock, the default, which stops
+	// reading the data connection until there is room,
+	// OverflowDropNewest or OverflowDropOldest.  Dropped messages
+	// are counted in ReceiveStats.
+	Action OverflowAction
+	// WarnAbove, if positive, is the backlog beyond which BacklogHook
+	// is called.
+	WarnAbove int
+}
+
+// BacklogHooks may be implemented by Hooks to be warned that received
+// messages are not being taken quickly enough.  BacklogHook is called
+// with the backlog when it grows beyond the ReceivePolicy's
+// WarnAbove, and not again until it has fallen to half of that.  The
+// backlog waiting for Receive, MsgsC and the C of each Subscription
+// are each warned about on their own.  Like
+// the error hooks, it is always called from the Client's go routines.
+type BacklogHooks interface {
+	BacklogHook(c *Client, backlog int)
+}
+
+// SetReceivePolicy sets what the Client does with received messages
+// when the receive backlog is full.
+func (c *Client) SetReceivePolicy(p ReceivePolicy) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	c.receive_policy.Store(&p)
+	return nil
+}
+
+func (p *ReceivePolicy) check() error {
+	switch p.Action {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	default:
+		return fmt.Errorf("unsupported receive overflow action %d", p.Action)
+	}
+	if p.WarnAbove < 0 {
+		return fmt.Errorf("receive backlog warning must not be negative: %d", p.WarnAbove)
+	}
+	return nil
+}
+
+// ReceiveStats returns how many received messages the ReceivePolicy
+// has dropped.
+func (c *Client) ReceiveStats() OverflowStats {
+	return OverflowStats{
+		DroppedNewest: c.receive_stats.dropped_newest.Load(),
+		DroppedOldest: c.receive_stats.dropped_oldest.Load(),
+	}
+}
+
+// receive_dropping returns the ReceivePolicy's action if it drops
+// messages rather than blocking.
+func (c *Client) receive_dropping() (OverflowAction, bool) {
+	p := c.receive_policy.Load()
+	if p == nil || p.Action == OverflowBlock {
+		return OverflowBlock, false
+	}
+	return p.Action, true
+}
+
+// receive_drop queues v on q without blocking, dropping v or the
+// oldest entries as action directs.  release recycles those dropped.
+// warned records whether q's backlog has been warned about.
+func receive_drop[T any](c *Client, action OverflowAction, q chan T, v T, release func(T), warned *atomic.Bool) {
+	select {
+	case q <- v:
+		c.receive_warn(warned, len(q))
+		return
+	default:
+	}
+	if action == OverflowDropOldest {
+		// Receive may be taking from the queue too, so keep going
+		// until there is room.
+		for cap(q) > 0 {
+			select {
+			case old := <-q:
+				c.receive_stats.dropped_oldest.Add(1)
+				release(old)
+			default:
+			}
+			select {
+			case q <- v:
+				c.receive_warn(warned, len(q))
+				return
+			default:
+			}
+		}
+	}
+	c.receive_stats.dropped_newest.Add(1)
+	release(v)
+}
+
+// receive_warn calls BacklogHook if the backlog of a queue has
+// crossed the ReceivePolicy's WarnAbove, unless warned says the
+// queue has been warned about already.
+func (c *Client) receive_warn(warned *atomic.Bool, backlog int) {
+	p := c.receive_policy.Load()
+	if p == nil || p.WarnAbove == 0 {
+		return
+	}
+	if backlog <= p.WarnAbove/2 {
+		warned.Store(false)
+		return
+	}
+	if backlog <= p.WarnAbove || !warned.CompareAndSwap(false, true) {
+		return
+	}
+	if bh, ok := c.get_hooks().(BacklogHooks); ok {
+		bh.BacklogHook(c, backlog)
+	}
+}
+
+// release_back recycles a dropped received message and its envelope.
+func release_back(bm *backMessage) {
+	bm.msg.Release()
+	bm.msg = nil
+	back_pool.Put(bm)
+}
@@ -0,0 +1,278 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerSelection decides which of several servers the Client
+// connects to.
+type ServerSelection int
+
+const (
+	// RotateServers stays with a server until it fails, then moves
+	// on to the next one in the list.
+	RotateServers ServerSelection = iota
+	// StickyPrimary returns to the first listed server that has not
+	// failed within the failover cooldown (see SetFailoverCooldown)
+	// each time it reconnects.
+	StickyPrimary
+	// HealthiestServer prefers the server with the fewest consecutive
+	// failures, and among those the one that failed longest ago.
+	HealthiestServer
+)
+
+const (
+	default_failover_cooldown = 30 * time.Second
+	default_resolve_interval  = time.Minute
+)
+
+// server is a single resolved address, the name it was resolved
+// from, and its health.
+type server struct {
+	addr      string
+	name      string
+	failures  int
+	last_fail time.Time
+}
+
+// SetServers sets the fq servers the Client fails over between, in
+// order of preference, replacing the host given to Creds.  Each is
+// "host:port", or just "host" to use FQ_DEFAULT_PORT.  A host name
+// resolving to several addresses counts as one server per address,
+// and a name of the form "_service._proto.domain" is looked up as a
+// DNS SRV record (its port, if any, is ignored).  Names are looked up
+// again periodically (see SetResolveInterval).  The Client moves to
+// another server when it cannot connect, or when its connection fails
+// or misses heartbeats; see SetServerSelection.
+func (c *Client) SetServers(addrs ...string) error {
+	specs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if is_srv(addr) {
+			specs[i] = strings.SplitN(addr, ":", 2)[0]
+			continue
+		}
+		host, port, err := split_addr(addr)
+		if err != nil {
+			return err
+		}
+		specs[i] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.server_specs = specs
+	c.last_resolve = time.Time{}
+	return nil
+}
+
+// SetServerSelection sets how the Client chooses among its servers.
+// The default is RotateServers.
+func (c *Client) SetServerSelection(sel ServerSelection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.selection = sel
+}
+
+// SetFailoverCooldown sets how long a failed server is passed over by
+// StickyPrimary before it is preferred again.  The default is 30
+// seconds.
+func (c *Client) SetFailoverCooldown(cooldown time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failover_cooldown = cooldown
+}
+
+// SetResolveInterval sets how often the server names given to
+// SetServers are looked up again.  The default is a minute.
+func (c *Client) SetResolveInterval(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resolve_interval = interval
+}
+
+// Server returns the address of the server the Client is connected
+// to, or last tried to connect to.
+func (c *Client) Server() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cur_server
+}
+
+func is_srv(addr string) bool {
+	return strings.HasPrefix(addr, "_") && strings.Contains(addr, "._")
+}
+
+// next_server picks the address for the next connection attempt.
+func (c *Client) next_server() string {
+	c.resolve()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.servers) == 0 {
+		c.cur_server = net.JoinHostPort(c.host, strconv.Itoa(int(c.port)))
+		return c.cur_server
+	}
+	pick := 0
+	switch c.selection {
+	case RotateServers:
+		for i, s := range c.servers {
+			if s.addr == c.cur_server {
+				pick = i
+				if s.failures > 0 {
+					pick = (i + 1) % len(c.servers)
+				}
+				break
+			}
+		}
+	case StickyPrimary:
+		for i, s := range c.servers {
+			if time.Since(s.last_fail) >= c.failover_cooldown {
+				pick = i
+				break
+			}
+			if s.last_fail.Before(c.servers[pick].last_fail) {
+				pick = i
+			}
+		}
+	case HealthiestServer:
+		for i, s := range c.servers {
+			best := c.servers[pick]
+			if s.failures < best.failures ||
+				(s.failures == best.failures && s.last_fail.Before(best.last_fail)) {
+				pick = i
+			}
+		}
+	}
+	c.cur_server = c.servers[pick].addr
+	return c.cur_server
+}
+
+// server_name returns the host name addr was resolved from, for TLS
+// server name indication and verification.  mu must be held.
+func (c *Client) server_name(addr string) string {
+	for _, s := range c.servers {
+		if s.addr == addr {
+			return s.name
+		}
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return host
+}
+
+// server_health records the outcome of a connection to addr.
+func (c *Client) server_health(addr string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.servers {
+		if s.addr == addr {
+			if ok {
+				s.failures = 0
+			} else {
+				s.failures++
+				s.last_fail = time.Now()
+			}
+			return
+		}
+	}
+}
+
+// resolve expands the server list into addresses if it has not been
+// done within the resolve interval.  A name that fails to resolve, or any
+// host name when a Dialer is set, is kept as is, leaving it to the
+// dialer.
+func (c *Client) resolve() {
+	c.mu.Lock()
+	specs, timeout := c.server_specs, c.dial_timeout
+	proxied := c.dialer != nil
+	stale := time.Since(c.last_resolve) >= c.resolve_interval
+	c.mu.Unlock()
+	if len(specs) == 0 || !stale {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var addrs []server
+	for _, spec := range specs {
+		if is_srv(spec) {
+			_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", spec)
+			if err != nil {
+				c.error(err)
+				continue
+			}
+			for _, srv := range srvs {
+				name := strings.TrimSuffix(srv.Target, ".")
+				addrs = append(addrs, server{
+					addr: net.JoinHostPort(name, strconv.Itoa(int(srv.Port))),
+					name: name,
+				})
+			}
+			continue
+		}
+		host, port, _ := net.SplitHostPort(spec)
+		if net.ParseIP(host) != nil || proxied {
+			addrs = append(addrs, server{addr: spec, name: host})
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			c.error(err)
+			addrs = append(addrs, server{addr: spec, name: host})
+			continue
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, server{addr: net.JoinHostPort(ip, port), name: host})
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// keep the health of servers we already knew
+	known := make(map[string]*server)
+	for _, s := range c.servers {
+		known[s.addr] = s
+	}
+	servers := make([]*server, 0, len(addrs))
+	seen := make(map[string]bool)
+	for _, a := range addrs {
+		if seen[a.addr] {
+			continue
+		}
+		seen[a.addr] = true
+		s := known[a.addr]
+		if s == nil {
+			s = &server{addr: a.addr}
+		}
+		s.name = a.name
+		servers = append(servers, s)
+	}
+	if len(servers) > 0 {
+		c.servers = servers
+	}
+	c.last_resolve = time.Now()
+}
@@ -0,0 +1,644 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"github.com/postwait/gofq/wire"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when spooled messages are flushed to stable
+// storage.  Messages are written to the spool files as they are
+// published either way, so they survive the process crashing; the
+// policy covers the machine crashing.
+type SyncPolicy int
+
+const (
+	// SyncPeriodically flushes every SpoolOptions.SyncInterval.
+	SyncPeriodically SyncPolicy = iota
+	// SyncAlways flushes every message before Publish returns.
+	SyncAlways
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// SpoolOptions configures a spool (see SetSpool).  Zero values select
+// the defaults.
+type SpoolOptions struct {
+	// SegmentSize is the size at which a spool file is closed and a
+	// new one started.  Files are deleted once all of their messages
+	// have been sent.  The default is 16MB.
+	SegmentSize int64
+	// MaxSize caps the total size of the spool files.  Publishing
+	// a message that does not fit fails with ErrSpoolFull.  The
+	// default is 1GB.
+	MaxSize int64
+	// Sync is when messages are flushed to stable storage.
+	Sync SyncPolicy
+	// SyncInterval is how often SyncPeriodically flushes.  The
+	// default is one second.
+	SyncInterval time.Duration
+}
+
+// SetSpool makes the Client publish through a spool kept in dir: an
+// append-only log of messages that are sent to the server from there,
+// and only removed once written to the data connection.  Messages
+// published while the Client is disconnected, or left unsent when the
+// process exits, are sent once it (or a later Client using the same
+// dir) connects.  As with the in-memory queue, a message whose write
+// fails is sent again, so the server can see it twice.
+//
+// With a spool, Publish and PublishAsync succeed once the message has
+// been spooled (and flushed, with SyncAlways), Close leaves unsent
+// messages spooled rather than returning them, and SetBacklog and
+// SetNonBlocking have no effect.  The dir must not be used by more
+// than one Client at a time.  SetSpool must be called before Connect.
+func (c *Client) SetSpool(dir string, opts SpoolOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected || c.spool != nil {
+		return fmt.Errorf("SetSpool must be called once, before Connect")
+	}
+	s, err := open_spool(dir, opts, c.peermode)
+	if err != nil {
+		return err
+	}
+	c.spool = s
+	return nil
+}
+
+const (
+	spool_DEFAULT_SEGMENT = 16 * 1024 * 1024
+	spool_DEFAULT_MAX     = 1024 * 1024 * 1024
+	spool_MAGIC           = "FQSP"
+	spool_VERSION         = 1
+	spool_FLAG_PEER       = 1
+	// each file starts with the magic, the version, flags and two
+	// reserved bytes
+	spool_HEADER = 8
+	// each message is preceded by its length and checksum
+	spool_RECORD = 8
+)
+
+var (
+	be        = binary.BigEndian
+	spool_crc = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// segment is one spool file, named by its id in hex.
+type segment struct {
+	id   uint64
+	size int64
+	peer bool
+}
+
+// spool is the on-disk log behind SetSpool.  Messages are appended to
+// the last segment; the data sender reads them back in batches from
+// the position recorded in the cursor file, which moves once a batch
+// has been written to the server.
+type spool struct {
+	dir  string
+	opts SpoolOptions
+	peer bool
+
+	mu      sync.Mutex
+	segs    []*segment
+	size    int64
+	pending int
+	w       *os.File
+	dirty   bool
+	r       *os.File
+	r_seg   *segment
+	r_off   int64
+	cursor  *os.File
+	rbuf    []byte
+	closed  bool
+
+	// ready is signalled when a message is appended.
+	ready chan struct{}
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// spool_pos is the position after a batch read from the spool.
+type spool_pos struct {
+	seg *segment
+	off int64
+	n   int
+}
+
+func open_spool(dir string, opts SpoolOptions, peer bool) (*spool, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = spool_DEFAULT_MAX
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = spool_DEFAULT_SEGMENT
+	}
+	opts.SegmentSize = min(opts.SegmentSize, opts.MaxSize)
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:   dir,
+		opts:  opts,
+		peer:  peer,
+		ready: make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.pending > 0 {
+		s.ready <- struct{}{}
+	}
+	if opts.Sync == SyncPeriodically {
+		s.wg.Add(1)
+		go s.syncer()
+	}
+	return s, nil
+}
+
+func (s *spool) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x.seg", id))
+}
+
+// recover finds the segments left in the spool, resumes reading where
+// the cursor says and checks every message not yet sent, cutting a
+// segment short where it finds one torn or corrupt.
+func (s *spool) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".seg")
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 16, 64)
+		if err != nil {
+			continue
+		}
+		s.segs = append(s.segs, &segment{id: id})
+	}
+	slices.SortFunc(s.segs, func(a, b *segment) int { return cmp.Compare(a.id, b.id) })
+
+	if s.cursor, err = os.OpenFile(filepath.Join(s.dir, "cursor"), os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+		return err
+	}
+	var cur [20]byte
+	cur_id, cur_off := uint64(0), int64(0)
+	if n, _ := s.cursor.ReadAt(cur[:], 0); n == len(cur) &&
+		crc32.Checksum(cur[:16], spool_crc) == be.Uint32(cur[16:]) {
+		cur_id, cur_off = be.Uint64(cur[:]), int64(be.Uint64(cur[8:]))
+	}
+
+	kept := s.segs[:0]
+	for _, seg := range s.segs {
+		if seg.id < cur_id {
+			// sent before we stopped
+			os.Remove(s.path(seg.id))
+			continue
+		}
+		start := int64(spool_HEADER)
+		if seg.id == cur_id {
+			start = max(start, cur_off)
+		}
+		if err := s.scan(seg, start); err != nil {
+			return err
+		}
+		if seg.id == cur_id && start > seg.size {
+			// the cursor is past a segment that was cut short
+			start = seg.size
+		}
+		if s.r_seg == nil {
+			s.r_seg, s.r_off = seg, start
+		}
+		kept = append(kept, seg)
+		s.size += seg.size
+	}
+	s.segs = kept
+
+	if n := len(s.segs); n > 0 {
+		last := s.segs[n-1]
+		if last.peer == s.peer && last.size < s.opts.SegmentSize {
+			if s.w, err = os.OpenFile(s.path(last.id), os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+	return s.rotate()
+}
+
+// scan checks the messages of seg from start, truncating the file at
+// the first that is incomplete or corrupt, and counts them as pending.
+func (s *spool) scan(seg *segment, start int64) error {
+	f, err := os.OpenFile(s.path(seg.id), os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var hdr [spool_HEADER]byte
+	if _, err := f.ReadAt(hdr[:], 0); err != nil || string(hdr[:4]) != spool_MAGIC || hdr[4] != spool_VERSION {
+		// not even a header made it; start the segment over
+		seg.peer = s.peer
+		seg.size = spool_HEADER
+		return write_header(f, s.peer)
+	}
+	seg.peer = hdr[5]&spool_FLAG_PEER != 0
+	seg.size = info.Size()
+	r := io.NewSectionReader(f, start, max(seg.size-start, 0))
+	off := start
+	var rec [spool_RECORD]byte
+	var msg []byte
+	for off < seg.size {
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			break
+		}
+		n := int64(be.Uint32(rec[:]))
+		if n > seg.size-off-spool_RECORD {
+			break
+		}
+		msg = slices.Grow(msg[:0], int(n))[:n]
+		if _, err := io.ReadFull(r, msg); err != nil ||
+			crc32.Checksum(msg, spool_crc) != be.Uint32(rec[4:]) {
+			break
+		}
+		off += spool_RECORD + n
+		s.pending++
+	}
+	if off < seg.size && start <= seg.size {
+		seg.size = off
+		return f.Truncate(off)
+	}
+	return nil
+}
+
+func write_header(f *os.File, peer bool) error {
+	hdr := [spool_HEADER]byte{'F', 'Q', 'S', 'P', spool_VERSION}
+	if peer {
+		hdr[5] = spool_FLAG_PEER
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt(hdr[:], 0)
+	return err
+}
+
+// rotate starts a new segment for writing.  mu must be held, or the
+// spool not yet shared.
+func (s *spool) rotate() error {
+	id := uint64(1)
+	if n := len(s.segs); n > 0 {
+		id = s.segs[n-1].id + 1
+	}
+	if s.w != nil {
+		if s.opts.Sync != SyncNever {
+			s.w.Sync()
+		}
+		s.w.Close()
+		s.w, s.dirty = nil, false
+	}
+	f, err := os.OpenFile(s.path(id), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := write_header(f, s.peer); err != nil {
+		f.Close()
+		return err
+	}
+	f.Seek(0, io.SeekEnd)
+	seg := &segment{id: id, size: spool_HEADER, peer: s.peer}
+	s.segs = append(s.segs, seg)
+	s.size += seg.size
+	s.w = f
+	if s.r_seg == nil {
+		s.r_seg, s.r_off = seg, seg.size
+	}
+	return nil
+}
+
+// append spools msg, encoded for the connection.
+func (s *spool) append(msg *Message) error {
+	rec := make([]byte, spool_RECORD, spool_RECORD+64+len(msg.Payload))
+	rec, err := fq_append_msg(rec, msg, s.peer)
+	if err != nil {
+		return err
+	}
+	be.PutUint32(rec, uint32(len(rec)-spool_RECORD))
+	be.PutUint32(rec[4:], crc32.Checksum(rec[spool_RECORD:], spool_crc))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.size+int64(len(rec)) > s.opts.MaxSize {
+		return ErrSpoolFull
+	}
+	last := s.segs[len(s.segs)-1]
+	if last.size > spool_HEADER && last.size+int64(len(rec)) > s.opts.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		last = s.segs[len(s.segs)-1]
+	}
+	if _, err := s.w.Write(rec); err != nil {
+		// don't leave a torn message for the reader
+		s.w.Truncate(last.size)
+		return err
+	}
+	last.size += int64(len(rec))
+	s.size += int64(len(rec))
+	s.pending++
+	if s.opts.Sync == SyncAlways {
+		if err := s.w.Sync(); err != nil {
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *spool) syncer() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		if s.dirty && s.w != nil {
+			s.w.Sync()
+			s.dirty = false
+		}
+		s.mu.Unlock()
+	}
+}
+
+// read appends to buf up to size bytes (or a single larger message) of
+// spooled messages, encoded for a connection in peer mode or not,
+// starting after the last batch committed.  It returns the position
+// to commit once buf has been sent, with no messages if there are none.
+func (s *spool) read(buf []byte, size int, peer bool) ([]byte, spool_pos, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.r_seg != nil && s.r_off >= s.r_seg.size {
+		if s.r_seg == s.segs[len(s.segs)-1] {
+			return buf, spool_pos{}, nil
+		}
+		// everything in it has been sent; move on to the next
+		s.next_segment()
+	}
+	if s.r_seg == nil {
+		return buf, spool_pos{}, nil
+	}
+	if s.r == nil {
+		var err error
+		if s.r, err = os.Open(s.path(s.r_seg.id)); err != nil {
+			return buf, spool_pos{}, err
+		}
+	}
+	seg, off := s.r_seg, s.r_off
+	chunk := int(min(int64(size), seg.size-off))
+	s.rbuf = slices.Grow(s.rbuf[:0], chunk)[:chunk]
+	if _, err := s.r.ReadAt(s.rbuf, off); err != nil {
+		return buf, spool_pos{}, err
+	}
+	pos := spool_pos{seg: seg, off: off}
+	for p := 0; p+spool_RECORD <= len(s.rbuf); {
+		n := int(be.Uint32(s.rbuf[p:]))
+		if p+spool_RECORD+n > len(s.rbuf) {
+			if p > 0 {
+				break
+			}
+			// a single message larger than size
+			if int64(spool_RECORD+n) > seg.size-off {
+				return buf, pos, s.corrupt(seg, off)
+			}
+			s.rbuf = slices.Grow(s.rbuf[:0], spool_RECORD+n)[:spool_RECORD+n]
+			if _, err := s.r.ReadAt(s.rbuf, off); err != nil {
+				return buf, spool_pos{}, err
+			}
+		}
+		rec := s.rbuf[p+spool_RECORD : p+spool_RECORD+n]
+		if crc32.Checksum(rec, spool_crc) != be.Uint32(s.rbuf[p+4:]) {
+			if pos.n > 0 {
+				// send what is good first
+				break
+			}
+			return buf, pos, s.corrupt(seg, off+int64(p))
+		}
+		if seg.peer == peer {
+			buf = append(buf, rec...)
+		} else {
+			var err error
+			if buf, err = transcode(buf, rec, seg.peer, peer); err != nil {
+				return buf, pos, s.corrupt(seg, off+int64(p))
+			}
+		}
+		p += spool_RECORD + n
+		pos.off, pos.n = off+int64(p), pos.n+1
+	}
+	return buf, pos, nil
+}
+
+// transcode appends the message rec, encoded in one mode, to buf
+// encoded in the other.
+func transcode(buf, rec []byte, from, to bool) ([]byte, error) {
+	dec := wire.NewDecoder(bytes.NewReader(rec))
+	dec.Peer = from
+	var m wire.Message
+	if err := dec.DecodeMessage(&m); err != nil {
+		return buf, err
+	}
+	return wire.AppendMessage(buf, &m, to)
+}
+
+// corrupt_error reports spooled messages that could not be read back
+// and were skipped.
+type corrupt_error struct {
+	path      string
+	off, skip int64
+}
+
+func (e *corrupt_error) Error() string {
+	return fmt.Sprintf("spool: %s corrupt at offset %d, skipping %d bytes", e.path, e.off, e.skip)
+}
+
+// corrupt skips the rest of a segment the reader cannot make sense
+// of.  mu must be held.
+func (s *spool) corrupt(seg *segment, off int64) error {
+	s.r_off = seg.size
+	return &corrupt_error{path: s.path(seg.id), off: off, skip: seg.size - off}
+}
+
+// next_segment deletes the segment the reader is done with and moves
+// on to the next.  mu must be held.
+func (s *spool) next_segment() {
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	os.Remove(s.path(s.r_seg.id))
+	s.size -= s.r_seg.size
+	s.segs = s.segs[1:]
+	s.r_seg, s.r_off = s.segs[0], spool_HEADER
+	s.save_cursor()
+}
+
+// commit records that the messages up to pos have been sent.
+func (s *spool) commit(pos spool_pos) {
+	if pos.n == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos.seg != s.r_seg || pos.off < s.r_off {
+		return
+	}
+	s.r_off = pos.off
+	s.pending -= pos.n
+	s.save_cursor()
+}
+
+// save_cursor records where reading resumes.  A cursor lost to a
+// crash only means messages are sent again.  mu must be held.
+func (s *spool) save_cursor() {
+	var cur [20]byte
+	be.PutUint64(cur[:], s.r_seg.id)
+	be.PutUint64(cur[8:], uint64(s.r_off))
+	be.PutUint32(cur[16:], crc32.Checksum(cur[:16], spool_crc))
+	s.cursor.WriteAt(cur[:], 0)
+	if s.opts.Sync == SyncAlways {
+		s.cursor.Sync()
+	}
+}
+
+// backlog returns the number of messages not yet sent.
+func (s *spool) backlog() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+func (s *spool) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	for _, f := range []*os.File{s.w, s.cursor} {
+		if f != nil && s.opts.Sync != SyncNever {
+			f.Sync()
+		}
+	}
+	for _, f := range []*os.File{s.w, s.r, s.cursor} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	s.w, s.r, s.cursor = nil, nil, nil
+	s.mu.Unlock()
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// spool_sender writes spooled messages to the data connection in
+// batches until the session ends or the connection fails.  Once
+// Close has been requested and the spool is empty, it stops the
+// Client.
+func (c *Client) spool_sender(conn net.Conn, sess *session, flushed, rcv_done chan bool) {
+	defer conn.Close()
+	c.mu.Lock()
+	size := c.batch_size
+	c.mu.Unlock()
+	var buf []byte
+	for {
+		var pos spool_pos
+		var err error
+		buf, pos, err = c.spool.read(buf[:0], size, c.peermode)
+		if err != nil {
+			c.error(err)
+			if _, skipped := err.(*corrupt_error); !skipped {
+				return
+			}
+		}
+		if pos.n > 0 {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+			c.spool.commit(pos)
+			continue
+		}
+		if err != nil {
+			// skipped something unreadable; carry on after it
+			continue
+		}
+		select {
+		case <-c.closing:
+			c.hang_up(conn, sess, flushed, rcv_done)
+			return
+		default:
+		}
+		select {
+		case <-sess.done:
+			return
+		case <-c.spool.ready:
+		case <-c.closing:
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package fq
+
+import (
+	"bytes"
+	"github.com/postwait/gofq/wire"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// drain reads everything from s, returning the payloads.
+func drain(t *testing.T, s *spool, peer bool) []string {
+	var payloads []string
+	for {
+		buf, pos, err := s.read(nil, 200, peer)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if pos.n == 0 {
+			return payloads
+		}
+		dec := wire.NewDecoder(bytes.NewReader(buf))
+		dec.Peer = peer
+		var m wire.Message
+		for i := 0; i < pos.n; i++ {
+			if err := dec.DecodeMessage(&m); err != nil {
+				t.Fatalf("DecodeMessage: %v", err)
+			}
+			payloads = append(payloads, string(m.Payload))
+		}
+		s.commit(pos)
+	}
+}
+
+func TestSpoolRecover(t *testing.T) {
+	dir := t.TempDir()
+	opts := SpoolOptions{SegmentSize: 256, Sync: SyncNever}
+	s, err := open_spool(dir, opts, false)
+	if err != nil {
+		t.Fatalf("open_spool: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := s.append(NewMessage("logging", "test.gotest.spool", []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	// send the first batch only
+	_, pos, err := s.read(nil, 200, false)
+	if err != nil || pos.n == 0 {
+		t.Fatalf("read: %d, %v", pos.n, err)
+	}
+	s.commit(pos)
+	sent := pos.n
+	s.close()
+
+	// a message torn by a crash is dropped
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segs) < 2 {
+		t.Fatalf("expected several segments, got %v", segs)
+	}
+	f, _ := os.OpenFile(segs[len(segs)-1], os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0, 0, 0, 40, 1, 2, 3})
+	f.Close()
+
+	s, err = open_spool(dir, opts, false)
+	if err != nil {
+		t.Fatalf("open_spool: %v", err)
+	}
+	if s.backlog() != 20-sent {
+		t.Errorf("backlog %d, want %d", s.backlog(), 20-sent)
+	}
+	s.append(NewMessage("logging", "test.gotest.spool", []byte("20")))
+	// read back in the other mode, as a peer
+	s.peer = true
+	got := drain(t, s, true)
+	if len(got) != 21-sent {
+		t.Fatalf("read %d messages, want %d", len(got), 21-sent)
+	}
+	for i, p := range got {
+		if p != strconv.Itoa(sent+i) {
+			t.Errorf("message %d: payload %q", sent+i, p)
+		}
+	}
+	s.close()
+
+	// without a usable cursor, everything left is sent again
+	os.WriteFile(filepath.Join(dir, "cursor"), []byte("bogus"), 0o644)
+	s, err = open_spool(dir, opts, false)
+	if err != nil {
+		t.Fatalf("open_spool: %v", err)
+	}
+	defer s.close()
+	if got := drain(t, s, false); len(got) == 0 {
+		t.Errorf("nothing read without a cursor")
+	}
+}
@@ -0,0 +1,309 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"context"
+	"iter"
+	"sync"
+	"sync/atomic"
+)
+
+// Subscription delivers the messages routed by one binding on C,
+// without the need to implement Hooks, so that one Client can feed
+// several independent consumers.  Messages delivered to a
+// Subscription bypass MessageHook and Receive.  C holds up to the
+// Client's backlog (see SetBacklog); when it is full, messages are
+// dropped or wait according to the ReceivePolicy.
+type Subscription struct {
+	// C receives the messages, unless they are passed to a handler
+	// (see SubscribeFunc).  It is closed when the Subscription
+	// ends, after which Err reports why.
+	C <-chan *Message
+
+	c        *Client
+	ch       chan *Message
+	exchange fq_rk
+	match    func(*Message) bool
+	handler  func(*Message)
+	route    uint32 // guarded by c.mu
+	done     chan struct{}
+	end_once sync.Once
+	mu       sync.RWMutex // held to send on ch
+	err      error
+	warned   atomic.Bool // of C's backlog
+}
+
+// Subscribe binds program on exchange transiently and returns a
+// Subscription delivering the messages it routes (see
+// SubscribeBind).  It blocks until the server has responded or ctx
+// is done, so it fails with ErrWouldDeadlock from the hooks that
+// BindContext cannot be called from.  An exchange name longer than
+// FQ_MAX_RK_LEN is refused with a *LimitError.
+func (c *Client) Subscribe(ctx context.Context, exchange, program string) (*Subscription, error) {
+	rk, err := checked_rk("exchange", exchange)
+	if err != nil {
+		return nil, err
+	}
+	return c.SubscribeBind(ctx, &BindReq{Exchange: rk, Flags: FQ_BIND_TRANS, Program: program})
+}
+
+func (c *Client) subscribe_bind(ctx context.Context, req *BindReq, handler func(*Message)) (*Subscription, error) {
+	req.compile()
+	// A handler has no use for C beyond seeing it closed.
+	ch := make(chan *Message)
+	if handler == nil {
+		ch = make(chan *Message, c.qmaxlen)
+	}
+	s := &Subscription{
+		C:        ch,
+		c:        c,
+		ch:       ch,
+		exchange: req.Exchange,
+		match:    route_matcher(req),
+		handler:  handler,
+		done:     make(chan struct{}),
+	}
+	// Registered first, so that no message routed by the new
+	// binding reaches the hooks instead.
+	c.subscribe(s)
+	route, err := c.bind_context(ctx, req, true)
+	if err != nil {
+		s.end(err)
+		c.unsubscribe(s)
+		return nil, err
+	}
+	c.mu.Lock()
+	s.route = route
+	c.mu.Unlock()
+	go func() {
+		select {
+		case <-c.quit:
+			s.end(ErrClosed)
+			c.unsubscribe(s)
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+// Messages subscribes like Subscribe and returns an iterator over the
+// messages delivered.  The iteration ends, yielding the error, if the
+// subscription fails or ends with an error, or when ctx is done.  The
+// Subscription is closed when the iteration ends, waiting no longer
+// than the dial timeout for its route to be unbound.
+func (c *Client) Messages(ctx context.Context, exchange, program string) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		s, err := c.Subscribe(ctx, exchange, program)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer func() {
+			// Neither a ctx that is done nor a lost connection may
+			// hold up the unbind for long.
+			c.mu.Lock()
+			timeout := c.dial_timeout
+			c.mu.Unlock()
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+			defer cancel()
+			s.CloseContext(ctx)
+		}()
+		for {
+			select {
+			case msg, ok := <-s.C:
+				if !ok {
+					if err := s.Err(); err != nil {
+						yield(nil, err)
+					}
+					return
+				}
+				if !yield(msg, nil) {
+					return
+				}
+			case <-ctx.Done():
+				yield(nil, ctx.Err())
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator over the messages delivered on C, ending,
+// with Err if it is not nil, once the Subscription has ended.
+func (s *Subscription) All() iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		for msg := range s.C {
+			if !yield(msg, nil) {
+				return
+			}
+		}
+		if err := s.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// Err returns why the Subscription ended: nil while it is active or
+// if it was closed, ErrClosed if the Client was closed, and an error
+// wrapping ErrBindFailed if its binding could not be replayed after
+// a reconnect.
+func (s *Subscription) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// Close is CloseContext without a deadline.
+func (s *Subscription) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext ends the Subscription, closing C, and unbinds its
+// route, blocking until the server has responded or ctx is done.  If
+// the unbind fails the route is no longer replayed on reconnect.
+// From the hooks that UnbindContext cannot be called from, C is
+// closed but the unbind fails with ErrWouldDeadlock.
+// Messages still on C may be drained after it returns.  Closing a
+// Subscription that has already ended does nothing.
+func (s *Subscription) CloseContext(ctx context.Context) error {
+	if !s.end(nil) {
+		return nil
+	}
+	// Until the route is unbound, messages it still routes are
+	// dropped rather than handed to the hooks.
+	defer s.c.unsubscribe(s)
+	s.c.mu.Lock()
+	req := &UnbindReq{Exchange: s.exchange, RouteId: s.route}
+	s.c.mu.Unlock()
+	err := s.c.UnbindContext(ctx, req)
+	if err != nil {
+		s.c.mu.Lock()
+		s.c.untrack(req.Exchange, req.RouteId)
+		s.c.mu.Unlock()
+	}
+	return err
+}
+
+// end stops delivery and closes C, recording err.  It reports whether
+// it was the first to do so.
+func (s *Subscription) end(err error) bool {
+	first := false
+	s.end_once.Do(func() {
+		first = true
+		close(s.done)
+		s.mu.Lock()
+		s.err = err
+		close(s.ch)
+		s.mu.Unlock()
+	})
+	return first
+}
+
+// deliver sends msg on C as the ReceivePolicy directs.  It returns
+// false if the data connection is done with while blocked.
+func (s *Subscription) deliver(msg *Message, sess *session, flushed chan bool) bool {
+	c := s.c
+	if s.handler != nil {
+		// Not under s.mu, as the handler may close s.
+		select {
+		case <-s.done:
+			msg.Release()
+		default:
+			s.handler(msg)
+		}
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	select {
+	case <-s.done:
+		msg.Release()
+		return true
+	default:
+	}
+	if action, ok := c.receive_dropping(); ok {
+		receive_drop(c, action, s.ch, msg, (*Message).Release, &s.warned)
+		return true
+	}
+	select {
+	case s.ch <- msg:
+		c.receive_warn(&s.warned, len(s.ch))
+	case <-s.done:
+		msg.Release()
+	case <-sess.done:
+		return false
+	case <-c.quit:
+		return false
+	case <-flushed:
+		// closing, as in data_receiver
+	}
+	return true
+}
+
+func (c *Client) subscribe(s *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subs := append([]*Subscription(nil), c.subscriptions()...)
+	subs = append(subs, s)
+	c.subs.Store(&subs)
+}
+
+func (c *Client) unsubscribe(s *Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var subs []*Subscription
+	for _, sub := range c.subscriptions() {
+		if sub != s {
+			subs = append(subs, sub)
+		}
+	}
+	c.subs.Store(&subs)
+}
+
+func (c *Client) subscriptions() []*Subscription {
+	if subs := c.subs.Load(); subs != nil {
+		return *subs
+	}
+	return nil
+}
+
+// resubscribe follows a replayed binding to its new route, or ends
+// the Subscription whose binding failed to be replayed with err.  The
+// caller holds c.mu.
+func (c *Client) resubscribe(exchange fq_rk, old, route uint32, err error) {
+	for _, s := range c.subscriptions() {
+		if s.exchange != exchange || s.route != old {
+			continue
+		}
+		if err != nil {
+			go func() {
+				s.end(err)
+				c.unsubscribe(s)
+			}()
+			continue
+		}
+		s.route = route
+	}
+}
@@ -0,0 +1,572 @@
+// Package fqtest provides an in-process fq server for hermetic tests.
+//
+// The Server speaks enough of the fq protocol (command, data and peer
+// mode handshakes, AUTH_PLAIN, heartbeats, bind/unbind, status and
+// message routing) to exercise a Client end to end over a loopback
+// listener without a running fqd.
+package fqtest
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/postwait/gofq/route"
+	"github.com/postwait/gofq/wire"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	bind_PERM    = uint16(0x00000110)
+	bind_ILLEGAL = uint32(0xffffffff)
+
+	max_HOPS     = wire.MaxHops
+	queue_MAXLEN = 10000
+)
+
+// Server is an in-process fq server listening on a loopback address.
+type Server struct {
+	// Listener is the network listener accepting fq connections.
+	Listener net.Listener
+
+	// Auth, if non-nil, is consulted for every AUTH_PLAIN attempt.
+	// Returning false rejects the client with a protocol error.  When
+	// nil, every user and password is accepted.
+	Auth func(user, pass string) bool
+
+	// TLS is the configuration of a Server started with StartTLS.
+	// It may be set before StartTLS to require client certificates
+	// or adjust other settings; StartTLS fills in the certificate.
+	TLS *tls.Config
+
+	mu         sync.Mutex
+	wg         sync.WaitGroup
+	started    bool
+	closed     bool
+	conns      map[net.Conn]bool
+	sessions   map[string]*session
+	queues     map[string]*queue
+	next_route uint32
+	stats      map[string]uint32
+}
+
+type binding struct {
+	id       uint32
+	flags    uint16
+	exchange string
+	program  string
+	prog     *route.Program
+	owner    *session
+}
+
+type queue struct {
+	name, qtype string
+	bindings    []*binding
+	out         chan []byte
+}
+
+type session struct {
+	key, user string
+	q         *queue
+	cmd_conn  net.Conn
+	data      []net.Conn
+	write_mu  sync.Mutex
+	hb_mu     sync.Mutex
+	hb_stop   chan bool
+}
+
+// NewServer starts and returns a new Server listening on a random
+// loopback port.  The caller should call Close when finished.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts and returns a new Server speaking TLS (see
+// StartTLS).  The caller should call Close when finished.
+func NewTLSServer() *Server {
+	s := NewUnstartedServer()
+	s.StartTLS()
+	return s
+}
+
+// NewUnstartedServer returns a new Server that has a listener but is
+// not yet accepting connections.  The caller may adjust the Server
+// (e.g. set Auth) before calling Start.
+func NewUnstartedServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("fqtest: failed to listen: %v", err))
+	}
+	return &Server{
+		Listener:   l,
+		conns:      make(map[net.Conn]bool),
+		sessions:   make(map[string]*session),
+		queues:     make(map[string]*queue),
+		next_route: 1,
+		stats: map[string]uint32{
+			"routed":   0,
+			"dropped":  0,
+			"no_route": 0,
+			"msgs_in":  0,
+			"msgs_out": 0,
+		},
+	}
+}
+
+// Start begins accepting connections on the Server's Listener.
+func (s *Server) Start() {
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		panic("fqtest: Server already started")
+	}
+	s.started = true
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go s.accept()
+}
+
+// StartTLS begins accepting TLS connections on the Server's
+// Listener, using a certificate for 127.0.0.1, ::1, localhost and
+// example.com generated for the Server (see Certificate).  If TLS
+// requires client certificates and has no ClientCAs, client
+// certificates are verified against the Server's own certificate.
+func (s *Server) StartTLS() {
+	if s.TLS == nil {
+		s.TLS = &tls.Config{}
+	}
+	cert := new_certificate()
+	s.TLS.Certificates = append(s.TLS.Certificates, cert)
+	if s.TLS.ClientCAs == nil {
+		s.TLS.ClientCAs = x509.NewCertPool()
+		s.TLS.ClientCAs.AddCert(cert.Leaf)
+	}
+	s.Listener = tls.NewListener(s.Listener, s.TLS)
+	s.Start()
+}
+
+// Addr returns the host:port the Server is listening on.
+func (s *Server) Addr() string {
+	return s.Listener.Addr().String()
+}
+
+// Host returns the host portion of the listening address, suitable
+// for passing to Client.Creds.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+// Port returns the port portion of the listening address, suitable
+// for passing to Client.Creds.
+func (s *Server) Port() uint16 {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.Atoi(port)
+	return uint16(p)
+}
+
+// Close shuts down the listener, disconnects all clients and waits
+// for the Server's goroutines to exit.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.Listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// DropConnections forcibly closes every client connection while
+// leaving the listener open, simulating a server restart.  Clients
+// are expected to reconnect on their own.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Stats returns a snapshot of the counters reported in response to
+// a status request.
+func (s *Server) Stats() map[string]uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vals := make(map[string]uint32, len(s.stats))
+	for k, v := range s.stats {
+		vals[k] = v
+	}
+	return vals
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.serve_conn(conn) {
+			return
+		}
+	}
+}
+
+// Dial connects to the Server over an in-memory net.Pipe, ignoring
+// network and addr.  It makes the Server an fq.Dialer, for tests that
+// should not touch the network.
+func (s *Server) Dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	if !s.serve_conn(server) {
+		return nil, fmt.Errorf("fqtest: Server closed")
+	}
+	return client, nil
+}
+
+// DialContext is Dial; connecting a pipe does not block.
+func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return s.Dial(network, addr)
+}
+
+// serve_conn serves conn in the background unless the Server has
+// been closed.
+func (s *Server) serve_conn(conn net.Conn) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+	go s.serve(conn)
+	return true
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer (func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	})()
+	dec := wire.NewDecoder(conn)
+	dec.MaxPayload, dec.MaxHops = max_PAYLOAD, max_HOPS
+	mode, err := dec.DecodeMode()
+	if err != nil {
+		return
+	}
+	switch mode {
+	case wire.CmdMode:
+		s.serve_cmd(conn, dec)
+	case wire.DataMode:
+		s.serve_data(conn, dec)
+	case wire.PeerMode, wire.OldPeerMode:
+		dec.Peer = true
+		s.serve_data(conn, dec)
+	}
+}
+
+func (s *Server) serve_cmd(conn net.Conn, dec *wire.Decoder) {
+	f, err := dec.Decode()
+	if err != nil {
+		return
+	}
+	auth, ok := f.(*wire.Auth)
+	if !ok {
+		return
+	}
+	qname, qtype := auth.Queue, auth.QueueType
+	if qtype == "" {
+		qtype = "mem"
+	}
+
+	if s.Auth != nil && !s.Auth(auth.User, auth.Password) {
+		if b, err := wire.AppendFrame(nil, &wire.Error{Reason: "auth failed"}); err == nil {
+			conn.Write(b)
+		}
+		return
+	}
+
+	sess := s.new_session(conn, auth.User, qname, qtype)
+	defer s.end_session(sess)
+
+	if err := sess.send(&wire.AuthResponse{Key: []byte(sess.key)}); err != nil {
+		return
+	}
+
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *wire.Heartbeat:
+		case *wire.HeartbeatRequest:
+			sess.heartbeat(f.Interval)
+		case *wire.BindRequest:
+			err = sess.send(&wire.BindResponse{
+				RouteID: s.bind(sess, f.Flags, f.Exchange, f.Program),
+			})
+		case *wire.UnbindRequest:
+			err = sess.send(&wire.UnbindResponse{
+				Success: s.unbind(sess, f.RouteID, f.Exchange),
+			})
+		case *wire.StatusRequest:
+			err = sess.send(&wire.Status{Stats: s.Stats()})
+		default:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) serve_data(conn net.Conn, dec *wire.Decoder) {
+	key, err := dec.DecodeSessionKey()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	sess, ok := s.sessions[string(key)]
+	if ok {
+		sess.data = append(sess.data, conn)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	done := make(chan bool)
+	defer close(done)
+	go (func(q *queue) {
+		for {
+			select {
+			case <-done:
+				return
+			case frame := <-q.out:
+				if _, err := conn.Write(frame); err != nil {
+					conn.Close()
+					return
+				}
+				s.count("msgs_out", 1)
+			}
+		}
+	})(sess.q)
+
+	for {
+		msg := &wire.Message{}
+		if err := dec.DecodeMessage(msg); err != nil {
+			return
+		}
+		if !dec.Peer {
+			msg.Sender, _ = wire.NewRk(sess.user)
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				if ip4 := addr.IP.To4(); ip4 != nil {
+					// hops are in host order on the wire
+					msg.Hops = append(msg.Hops, binary.NativeEndian.Uint32(ip4))
+				}
+			}
+		}
+		s.route(msg)
+	}
+}
+
+func (s *Server) new_session(conn net.Conn, user, qname, qtype string) *session {
+	var rnd [8]byte
+	rand.Read(rnd[:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[qname]
+	if !ok {
+		q = &queue{
+			name:  qname,
+			qtype: qtype,
+			out:   make(chan []byte, queue_MAXLEN),
+		}
+		s.queues[qname] = q
+	}
+	sess := &session{
+		key:      hex.EncodeToString(rnd[:]),
+		user:     user,
+		q:        q,
+		cmd_conn: conn,
+	}
+	s.sessions[sess.key] = sess
+	return sess
+}
+
+func (s *Server) end_session(sess *session) {
+	sess.heartbeat(0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sess.key)
+	for _, conn := range sess.data {
+		conn.Close()
+	}
+	kept := sess.q.bindings[:0]
+	for _, b := range sess.q.bindings {
+		if b.owner != sess || b.flags&bind_PERM == bind_PERM {
+			kept = append(kept, b)
+		}
+	}
+	sess.q.bindings = kept
+}
+
+func (s *Server) bind(sess *session, flags uint16, exchange, program string) uint32 {
+	prog, err := route.Parse(program)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil || exchange == "" {
+		return bind_ILLEGAL
+	}
+	b := &binding{
+		id:       s.next_route,
+		flags:    flags,
+		exchange: exchange,
+		program:  program,
+		prog:     prog,
+		owner:    sess,
+	}
+	s.next_route++
+	sess.q.bindings = append(sess.q.bindings, b)
+	return b.id
+}
+
+func (s *Server) unbind(sess *session, route_id uint32, exchange string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, b := range sess.q.bindings {
+		if b.id == route_id && b.exchange == exchange {
+			sess.q.bindings = append(sess.q.bindings[:i], sess.q.bindings[i+1:]...)
+			return 1
+		}
+	}
+	return 0
+}
+
+func (s *Server) route(msg *wire.Message) {
+	var frame []byte
+	exchange := msg.Exchange.String()
+	fmsg := to_fq(msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats["msgs_in"]++
+	delivered := false
+	for _, q := range s.queues {
+		for _, b := range q.bindings {
+			if b.exchange != exchange || !b.prog.Match(fmsg) {
+				continue
+			}
+			if frame == nil {
+				var err error
+				if frame, err = encode(msg); err != nil {
+					s.stats["dropped"]++
+					return
+				}
+			}
+			select {
+			case q.out <- frame:
+				s.stats["routed"]++
+			default:
+				s.stats["dropped"]++
+			}
+			delivered = true
+			break
+		}
+	}
+	if !delivered {
+		s.stats["no_route"]++
+	}
+}
+
+func (s *Server) count(stat string, n uint32) {
+	s.mu.Lock()
+	s.stats[stat] += n
+	s.mu.Unlock()
+}
+
+// send writes a command response in a single call.
+func (sess *session) send(f wire.Frame) error {
+	b, err := wire.AppendFrame(nil, f)
+	if err != nil {
+		return err
+	}
+	return sess.write(b)
+}
+
+func (sess *session) write(b []byte) error {
+	sess.write_mu.Lock()
+	defer sess.write_mu.Unlock()
+	_, err := sess.cmd_conn.Write(b)
+	return err
+}
+
+// heartbeat (re)starts the heartbeat emitter at the given interval,
+// an interval of zero stops it.
+func (sess *session) heartbeat(interval time.Duration) {
+	sess.hb_mu.Lock()
+	defer sess.hb_mu.Unlock()
+	if sess.hb_stop != nil {
+		close(sess.hb_stop)
+		sess.hb_stop = nil
+	}
+	if interval > 0 {
+		sess.hb_stop = make(chan bool)
+		go (func(stop chan bool) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			hb, _ := wire.AppendFrame(nil, &wire.Heartbeat{})
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					if sess.write(hb) != nil {
+						return
+					}
+				}
+			}
+		})(sess.hb_stop)
+	}
+}
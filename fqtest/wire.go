@@ -0,0 +1,47 @@
+package fqtest
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"github.com/postwait/gofq"
+	"github.com/postwait/gofq/wire"
+)
+
+// The server never trusts a peer for more than this much payload.
+const max_PAYLOAD = 64 * 1024 * 1024
+
+// to_fq converts msg to the client's representation so that routing
+// programs can be evaluated against it.
+func to_fq(msg *wire.Message) *fq.Message {
+	m := fq.NewMessage(msg.Exchange.String(), msg.Route.String(), msg.Payload)
+	m.Sender = fq.Rk(msg.Sender.String())
+	m.Hops = msg.Hops
+	return m
+}
+
+// encode renders the message as delivered to a subscriber, which is
+// always in the peer format.
+func encode(msg *wire.Message) ([]byte, error) {
+	return wire.AppendMessage(make([]byte, 0, 64+len(msg.Payload)), msg, true)
+}
@@ -0,0 +1,58 @@
+package fq
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// SetTLSConfig makes the Client speak TLS on both its command and
+// data connections, as when fq is behind a TLS terminating proxy.
+// Client certificates are taken from config.  If config.ServerName
+// is empty, the name of the server being connected to is used for
+// SNI and to verify its certificate; for servers resolved from a
+// host name or SRV record that is the name, not the address.  The
+// config is not modified.  A nil config turns TLS off.
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tls_config = config
+}
+
+// start_tls performs the client TLS handshake on conn, closing it if
+// that fails.
+func start_tls(ctx context.Context, conn net.Conn, config *tls.Config, name string) (net.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = name
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
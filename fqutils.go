@@ -24,215 +24,54 @@ package fq
  */
 
 import (
-	"fmt"
-	"net"
+	"bytes"
+	"github.com/postwait/gofq/wire"
+	"runtime"
+	"strconv"
 )
 
-func fq_read_complete(conn net.Conn, data []byte, want int) error {
-	sofar := 0
-	if want > cap(data) {
-		panic("requested buffer overrun")
-	}
-	for {
-		n, err := conn.Read(data[sofar:want])
-		if err != nil {
-			return err
-		}
-		sofar += n
-		if sofar > want {
-			panic("over read")
-		}
-		if sofar == want {
-			return nil
-		}
-	}
-}
-func fq_read_uint8(conn net.Conn) (uint8, error) {
-	buf := make([]byte, 1)
-	if err := fq_read_complete(conn, buf, 1); err != nil {
-		return 0, err
-	}
-	return uint8(buf[0]), nil
-}
-func fq_read_uint16(conn net.Conn) (uint16, error) {
-	buf := make([]byte, 2)
-	if err := fq_read_complete(conn, buf, 2); err != nil {
-		return 0, err
-	}
-	return be.Uint16(buf), nil
-}
-func fq_read_uint32(conn net.Conn) (uint32, error) {
-	buf := make([]byte, 4)
-	if err := fq_read_complete(conn, buf, 4); err != nil {
-		return 0, err
-	}
-	return be.Uint32(buf), nil
-}
-func fq_write_uint8(conn net.Conn, v uint8) error {
-	cmd := [1]byte{v}
-	n, err := conn.Write(cmd[:])
-	if err != nil {
-		return err
-	}
-	if n != len(cmd) {
-		return fmt.Errorf("bad write (size)")
-	}
-	return nil
-}
-func fq_write_uint16(conn net.Conn, v uint16) error {
-	cmd := make([]byte, 2)
-	be.PutUint16(cmd, v)
-	n, err := conn.Write(cmd[:])
-	if err != nil {
-		return err
-	}
-	if n != len(cmd) {
-		return fmt.Errorf("bad write (size)")
-	}
-	return nil
-}
-func fq_write_uint32(conn net.Conn, v uint32) error {
-	cmd := make([]byte, 4)
-	be.PutUint32(cmd, v)
-	n, err := conn.Write(cmd[:])
-	if err != nil {
-		return err
-	}
-	if n != len(cmd) {
-		return fmt.Errorf("bad write (size)")
-	}
-	return nil
-}
-func fq_write_byte_cmd(conn net.Conn, dlen uint8, data []byte) error {
-	if err := fq_write_uint8(conn, dlen); err != nil {
-		return err
-	}
-	n, err := conn.Write(data[:int(dlen)])
-	if err != nil {
-		return err
-	}
-	if n != int(dlen) {
-		return fmt.Errorf("bad write (data)")
-	}
-	return nil
-}
-func fq_write_short_cmd(conn net.Conn, dlen uint16, data []byte) error {
-	if err := fq_write_uint16(conn, dlen); err != nil {
-		return err
-	}
-	n, err := conn.Write(data[:int(dlen)])
-	if err != nil {
-		return err
-	}
-	if n != int(dlen) {
-		return fmt.Errorf("bad write (data)")
-	}
-	return nil
-}
-func fq_write_long_cmd(conn net.Conn, dlen uint32, data []byte) error {
-	if err := fq_write_uint32(conn, dlen); err != nil {
-		return err
-	}
-	if dlen == 0 {
-		return nil
-	}
-	n, err := conn.Write(data[:int(dlen)])
-	if err != nil {
-		return err
-	}
-	if n != int(dlen) {
-		return fmt.Errorf("bad write (data)")
-	}
-	return nil
-}
-func fq_read_rk(conn net.Conn, rk *fq_rk) error {
-	var err error
-	if rk.Len, err = fq_read_uint8(conn); err != nil {
-		return err
-	}
-	if err = fq_read_complete(conn, rk.Name[:], int(rk.Len)); err != nil {
-		return err
-	}
-	return nil
+// goid returns the id of the calling go routine, as given at the top
+// of its stack trace ("goroutine 7 [running]:").
+func goid() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i > 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
 }
-func fq_read_msg(conn net.Conn) (*Message, error) {
-	var err error
-	msg := &Message{}
-	if err = fq_read_rk(conn, &msg.Exchange); err != nil {
-		return nil, err
-	}
-	if err = fq_read_rk(conn, &msg.Route); err != nil {
-		return nil, err
-	}
-	if err = fq_read_complete(conn, msg.Sender_msgid.d[:], 16); err != nil {
-		return nil, err
-	}
-	// We're always in peermode as a receiving client
-	if err = fq_read_rk(conn, &msg.Sender); err != nil {
-		return nil, err
-	}
-	var nhops uint8
-	if nhops, err = fq_read_uint8(conn); err != nil {
-		return nil, err
-	}
-	if nhops > 0 {
-		hopbuf := make([]byte, 4*int(nhops))
-		if err = fq_read_complete(conn, hopbuf, 4*int(nhops)); err != nil {
-			return nil, err
-		}
-		msg.Hops = make([]uint32, nhops)
-		for i := 0; i < int(nhops); i++ {
-			msg.Hops[i] = ne.Uint32(hopbuf[i*4:])
-		}
-	}
-	var payload_len uint32
-	if payload_len, err = fq_read_uint32(conn); err != nil {
+
+// fq_read_msg reads a message from a data connection into a Message
+// from msg_pool, decoding through wm so that the pooled buffers are
+// reused.  It returns io.EOF only if the connection ended between
+// messages.
+func fq_read_msg(dec *wire.Decoder, wm *wire.Message) (*Message, error) {
+	msg := new_message()
+	wm.Hops, wm.Payload = msg.Hops[:0], msg.Payload[:0]
+	if err := dec.DecodeMessage(wm); err != nil {
+		msg.Hops, msg.Payload = wm.Hops, wm.Payload
+		msg.Release()
 		return nil, err
 	}
-	msg.Payload = make([]byte, int(payload_len))
-	if payload_len > 0 {
-		if err = fq_read_complete(conn, msg.Payload, int(payload_len)); err != nil {
-			return nil, err
-		}
-	}
+	msg.Exchange = fq_rk(wm.Exchange)
+	msg.Route = fq_rk(wm.Route)
+	msg.Sender = fq_rk(wm.Sender)
+	msg.Sender_msgid.d = wm.ID
+	msg.Hops, msg.Payload = wm.Hops, wm.Payload
+	wm.Hops, wm.Payload = nil, nil
 	return msg, nil
 }
-func fq_write_msg(conn net.Conn, msg *Message, peermode bool) error {
-	if err := fq_write_byte_cmd(conn, msg.Exchange.Len, msg.Exchange.Name[:]); err != nil {
-		return err
-	}
-	if err := fq_write_byte_cmd(conn, msg.Route.Len, msg.Route.Name[:]); err != nil {
-		return err
-	}
-	if n, err := conn.Write(msg.Sender_msgid.d[:]); err != nil || n != 16 {
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("bad write msgid")
-	}
-	if peermode {
-		if err := fq_write_byte_cmd(conn, msg.Sender.Len, msg.Sender.Name[:]); err != nil {
-			return err
-		}
-		nhops := len(msg.Hops)
-		if err := fq_write_uint8(conn, uint8(nhops)); err != nil {
-			return err
-		}
-		if nhops > 0 {
-			hopbuf := make([]byte, 4*nhops)
-			for i := 0; i < int(nhops); i++ {
-				ne.PutUint32(hopbuf[(i*4):], msg.Hops[i])
-			}
-			if n, err := conn.Write(hopbuf); err != nil || n != len(hopbuf) {
-				if err != nil {
-					return err
-				}
-				return fmt.Errorf("bad write msgid")
-			}
-		}
-	}
-	if err := fq_write_long_cmd(conn, uint32(len(msg.Payload)), msg.Payload); err != nil {
-		return err
-	}
-	return nil
+
+// fq_append_msg appends the wire encoding of msg to buf.
+func fq_append_msg(buf []byte, msg *Message, peermode bool) ([]byte, error) {
+	return wire.AppendMessage(buf, &wire.Message{
+		Exchange: wire.Rk(msg.Exchange),
+		Route:    wire.Rk(msg.Route),
+		Sender:   wire.Rk(msg.Sender),
+		ID:       msg.Sender_msgid.d,
+		Hops:     msg.Hops,
+		Payload:  msg.Payload,
+	}, peermode)
 }
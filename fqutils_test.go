@@ -0,0 +1,131 @@
+package fq
+
+import (
+	"bytes"
+	"github.com/postwait/gofq/wire"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// peer_decoder reads messages from r as a client does.
+func peer_decoder(r io.Reader) *wire.Decoder {
+	dec := wire.NewDecoder(r)
+	dec.Peer = true
+	return dec
+}
+
+func TestReadMsg(t *testing.T) {
+	in := NewMessage("logging", "test.gotest.wire", []byte("payload"))
+	in.Sender = Rk("gotest")
+	in.Hops = []uint32{1, 2, 3}
+	empty := NewMessage("logging", "test.gotest.empty", nil)
+	buf, err := fq_append_msg(nil, in, true)
+	if err == nil {
+		buf, err = fq_append_msg(buf, empty, true)
+	}
+	if err != nil {
+		t.Fatalf("fq_append_msg: %v", err)
+	}
+
+	dec := peer_decoder(bytes.NewReader(buf))
+	var wm wire.Message
+	out, err := fq_read_msg(dec, &wm)
+	if err != nil {
+		t.Fatalf("fq_read_msg: %v", err)
+	}
+	out.pooled = false
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("read %+v, wrote %+v", out, in)
+	}
+	out.pooled = true
+	out.Release()
+	// the released message may be reused; nothing may leak from it
+	out, err = fq_read_msg(dec, &wm)
+	if err != nil {
+		t.Fatalf("fq_read_msg: %v", err)
+	}
+	if out.Route != empty.Route || len(out.Payload) != 0 || len(out.Hops) != 0 {
+		t.Errorf("read %+v, wrote %+v", out, empty)
+	}
+	if _, err := fq_read_msg(dec, &wm); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// truncated anywhere
+	for n := 1; n < len(buf)/2; n++ {
+		dec := peer_decoder(bytes.NewReader(buf[:n]))
+		if _, err := fq_read_msg(dec, &wm); err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncated at %d: expected ErrUnexpectedEOF, got %v", n, err)
+		}
+	}
+
+	in.Hops = make([]uint32, 256)
+	if _, err := fq_append_msg(nil, in, true); err == nil {
+		t.Errorf("encoded %d hops", len(in.Hops))
+	}
+}
+
+func FuzzReadMsg(f *testing.F) {
+	msg := NewMessage("logging", "test.gotest.fuzz", []byte("payload"))
+	msg.Hops = []uint32{1, 2}
+	b, _ := fq_append_msg(nil, msg, true)
+	f.Add(b)
+	f.Add(append(b[:len(b)-len("payload")-4:len(b)-len("payload")-4], 0xff, 0xff, 0xff, 0xff))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		dec := peer_decoder(bytes.NewReader(b))
+		var wm wire.Message
+		for {
+			msg, err := fq_read_msg(dec, &wm)
+			if err != nil {
+				return
+			}
+			if len(msg.Hops) > wire.MaxHops || len(msg.Payload) > len(b) {
+				t.Fatalf("read %d hops, %d bytes from %d", len(msg.Hops), len(msg.Payload), len(b))
+			}
+			msg.Release()
+		}
+	})
+}
+
+// repeater endlessly yields the same bytes.
+type repeater struct {
+	b   []byte
+	off int
+}
+
+func (r *repeater) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.b)
+	}
+	return n, nil
+}
+
+func BenchmarkReadMsg(b *testing.B) {
+	msg := NewMessage("logging", "test.gotest.bench", bytes.Repeat([]byte("x"), 100))
+	enc, _ := fq_append_msg(nil, msg, true)
+	for _, release := range []bool{false, true} {
+		name := "unreleased"
+		if release {
+			name = "released"
+		}
+		b.Run(name, func(b *testing.B) {
+			dec := peer_decoder(&repeater{b: enc})
+			var wm wire.Message
+			b.SetBytes(int64(len(enc)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m, err := fq_read_msg(dec, &wm)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if release {
+					m.Release()
+				}
+			}
+		})
+	}
+}
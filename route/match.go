@@ -0,0 +1,187 @@
+package route
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/postwait/gofq"
+	"math/rand"
+	"sync"
+)
+
+// MatchFunc evaluates a filter function against a message.  args
+// have the types given by the signature the function was registered
+// with.
+type MatchFunc func(msg *fq.Message, args []Arg) bool
+
+type impl struct {
+	sig string
+	fn  MatchFunc
+	// random is set for functions, such as sample, whose outcome
+	// differs from call to call.
+	random bool
+}
+
+// funcs maps the name of each filter function known to fqd to its
+// signatures.  Functions may be overloaded on their argument types.
+var (
+	funcs_mu sync.RWMutex
+	funcs    = map[string][]impl{
+		"sample":           {{"d", sample, true}},
+		"route_contains":   {{"s", route_contains, false}},
+		"route_prefix":     {{"s", route_prefix, false}},
+		"payload_prefix":   {{"s", payload_prefix, false}},
+		"payload_contains": {{"s", payload_contains, false}},
+	}
+)
+
+// RegisterFunc makes a filter function loaded into the server known
+// to Compile and Parse.  sig lists the argument types in fqd's
+// notation: s for string, d for number and b for bool, so the C
+// function fqd_route_prog__substr_eq__ddsb is registered with
+// RegisterFunc("substr_eq", "ddsb", fn).  fn implements the function
+// for Match and must give the same answer every time for the same
+// message; if it is nil, calls evaluate to false, and MayMatch counts
+// them as true.  Programs compiled before the function is registered
+// do not see it.
+func RegisterFunc(name, sig string, fn MatchFunc) error {
+	if !valid_ident(name) {
+		return fmt.Errorf("route: invalid function name %q", name)
+	}
+	for _, t := range []byte(sig) {
+		if ArgType(t) != String && ArgType(t) != Number && ArgType(t) != Bool {
+			return fmt.Errorf("route: invalid signature %q", sig)
+		}
+	}
+	funcs_mu.Lock()
+	defer funcs_mu.Unlock()
+	for i, f := range funcs[name] {
+		if f.sig == sig {
+			funcs[name][i].fn = fn
+			return nil
+		}
+	}
+	funcs[name] = append(funcs[name], impl{sig, fn, false})
+	return nil
+}
+
+// Match reports whether msg would be routed by p, evaluating the
+// route pattern and filter functions as fqd does.  As on the server,
+// sample is random, so successive calls may disagree.
+func (p *Program) Match(msg *fq.Message) bool {
+	return p.eval(msg, eval_random)
+}
+
+// MayMatch reports whether msg could be routed by p.  Unlike Match it
+// gives the same answer every time: calls of sample, and of functions
+// registered without an implementation, count as whichever outcome
+// lets msg through, so it reports false only for messages p would
+// never route.  fq.Client uses it to tell which binding routed a
+// message.
+func (p *Program) MayMatch(msg *fq.Message) bool {
+	return p.eval(msg, eval_may)
+}
+
+// mode selects how calls whose outcome cannot be known in advance are
+// evaluated: those of random functions and of functions registered
+// without an implementation.
+type mode int
+
+const (
+	// eval_random calls them, as fqd does.
+	eval_random mode = iota
+	// eval_may counts them as true.
+	eval_may
+	// eval_must counts them as false.
+	eval_must
+)
+
+// negate returns the mode in which the negation of a rule is to be
+// evaluated: a rule that may be true must not be false.
+func (m mode) negate() mode {
+	switch m {
+	case eval_may:
+		return eval_must
+	case eval_must:
+		return eval_may
+	}
+	return m
+}
+
+func (p *Program) eval(msg *fq.Message, m mode) bool {
+	route := msg.Route.Name[:msg.Route.Len]
+	switch p.Kind {
+	case PrefixMatch:
+		if !bytes.HasPrefix(route, []byte(p.Pattern)) {
+			return false
+		}
+	case ExactMatch:
+		if string(route) != p.Pattern {
+			return false
+		}
+	default:
+		return false
+	}
+	return p.match == nil || p.match(msg, m)
+}
+
+func call_cond(f impl, args []Arg) cond {
+	return func(msg *fq.Message, m mode) bool {
+		if m != eval_random && (f.random || f.fn == nil) {
+			return m == eval_may
+		}
+		return f.fn != nil && f.fn(msg, args)
+	}
+}
+func not_cond(x cond) cond {
+	return func(msg *fq.Message, m mode) bool { return !x(msg, m.negate()) }
+}
+func and_cond(x, y cond) cond {
+	return func(msg *fq.Message, m mode) bool { return x(msg, m) && y(msg, m) }
+}
+func or_cond(x, y cond) cond {
+	return func(msg *fq.Message, m mode) bool { return x(msg, m) || y(msg, m) }
+}
+
+// sample(rate) accepts the given fraction of messages.
+func sample(msg *fq.Message, args []Arg) bool {
+	return rand.Float64() < args[0].Num
+}
+
+func route_contains(msg *fq.Message, args []Arg) bool {
+	return bytes.Contains(msg.Route.Name[:msg.Route.Len], []byte(args[0].Str))
+}
+
+func route_prefix(msg *fq.Message, args []Arg) bool {
+	return bytes.HasPrefix(msg.Route.Name[:msg.Route.Len], []byte(args[0].Str))
+}
+
+func payload_prefix(msg *fq.Message, args []Arg) bool {
+	return bytes.HasPrefix(msg.Payload, []byte(args[0].Str))
+}
+
+func payload_contains(msg *fq.Message, args []Arg) bool {
+	return bytes.Contains(msg.Payload, []byte(args[0].Str))
+}
@@ -0,0 +1,337 @@
+package route
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// SyntaxError describes a malformed program.
+type SyntaxError struct {
+	// Offset is the byte offset in the program at which the error
+	// was detected.
+	Offset int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("route: offset %d: %s", e.Offset, e.Msg)
+}
+
+type token int
+
+const (
+	tok_EOF token = iota
+	tok_IDENT
+	tok_STRING
+	tok_NUMBER
+	tok_LPAREN
+	tok_RPAREN
+	tok_LBRACE
+	tok_RBRACE
+	tok_COMMA
+	tok_COLON
+	tok_AND
+	tok_OR
+	tok_NOT
+)
+
+var token_names = [...]string{
+	tok_EOF:    "end of program",
+	tok_IDENT:  "identifier",
+	tok_STRING: "string",
+	tok_NUMBER: "number",
+	tok_LPAREN: "'('",
+	tok_RPAREN: "')'",
+	tok_LBRACE: "'{'",
+	tok_RBRACE: "'}'",
+	tok_COMMA:  "','",
+	tok_COLON:  "':'",
+	tok_AND:    "'&&'",
+	tok_OR:     "'||'",
+	tok_NOT:    "'!'",
+}
+
+func (t token) String() string { return token_names[t] }
+
+type parser struct {
+	src string
+	// the current token, its offset and text
+	tok token
+	pos int
+	lit string
+	// offset of the next token
+	next int
+}
+
+// Parse compiles the textual form of a program, such as
+// `prefix:"check." {route_contains("cpu")}`.  Errors are reported as
+// a *SyntaxError giving the offset of the problem.
+func Parse(src string) (*Program, error) {
+	p := &parser{src: src}
+	if err := p.scan(); err != nil {
+		return nil, err
+	}
+	prog := &Program{}
+	if p.tok != tok_IDENT || (p.lit != "prefix" && p.lit != "exact") {
+		return nil, p.errorf("expected prefix: or exact:")
+	}
+	if p.lit == "exact" {
+		prog.Kind = ExactMatch
+	}
+	if err := p.scan(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(tok_COLON); err != nil {
+		return nil, err
+	}
+	if p.tok != tok_STRING {
+		return nil, p.errorf("expected string, found %v", p.tok)
+	}
+	prog.Pattern = p.lit
+	if err := p.scan(); err != nil {
+		return nil, err
+	}
+	if p.tok == tok_LBRACE {
+		if err := p.scan(); err != nil {
+			return nil, err
+		}
+		rule, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tok_RBRACE); err != nil {
+			return nil, err
+		}
+		match, err := rule.compile()
+		if err != nil {
+			return nil, err
+		}
+		prog.Rule = rule
+		prog.match = match
+	}
+	if p.tok != tok_EOF {
+		return nil, p.errorf("unexpected %v after program", p.tok)
+	}
+	prog.text = prog.format()
+	return prog, nil
+}
+
+// MustParse is like Parse but panics if the program is invalid.
+func MustParse(src string) *Program {
+	p, err := Parse(src)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p *parser) or() (Expr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == tok_OR {
+		if err := p.scan(); err != nil {
+			return nil, err
+		}
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = &OrExpr{X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok == tok_AND {
+		if err := p.scan(); err != nil {
+			return nil, err
+		}
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = &AndExpr{X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) unary() (Expr, error) {
+	switch p.tok {
+	case tok_NOT:
+		if err := p.scan(); err != nil {
+			return nil, err
+		}
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &NotExpr{X: x}, nil
+	case tok_LPAREN:
+		if err := p.scan(); err != nil {
+			return nil, err
+		}
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(tok_RPAREN)
+	case tok_IDENT:
+		return p.call()
+	}
+	return nil, p.errorf("expected function call, found %v", p.tok)
+}
+
+func (p *parser) call() (Expr, error) {
+	e := &FuncCall{Name: p.lit, Pos: p.pos}
+	if err := p.scan(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(tok_LPAREN); err != nil {
+		return nil, err
+	}
+	for p.tok != tok_RPAREN {
+		if len(e.Args) > 0 {
+			if err := p.expect(tok_COMMA); err != nil {
+				return nil, err
+			}
+		}
+		var a Arg
+		switch {
+		case p.tok == tok_STRING:
+			a = Arg{Type: String, Str: p.lit}
+		case p.tok == tok_NUMBER:
+			n, err := strconv.ParseFloat(p.lit, 64)
+			if err != nil {
+				return nil, p.errorf("invalid number %s", p.lit)
+			}
+			a = Arg{Type: Number, Num: n}
+		case p.tok == tok_IDENT && (p.lit == "true" || p.lit == "false"):
+			a = Arg{Type: Bool, Bool: p.lit == "true"}
+		default:
+			return nil, p.errorf("expected argument, found %v", p.tok)
+		}
+		e.Args = append(e.Args, a)
+		if err := p.scan(); err != nil {
+			return nil, err
+		}
+	}
+	return e, p.scan()
+}
+
+func (p *parser) expect(t token) error {
+	if p.tok != t {
+		return p.errorf("expected %v, found %v", t, p.tok)
+	}
+	return p.scan()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Offset: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// scan reads the token at p.next into p.tok, p.pos and p.lit.
+func (p *parser) scan() error {
+	i := p.next
+	for i < len(p.src) && (p.src[i] == ' ' || p.src[i] == '\t' || p.src[i] == '\n' || p.src[i] == '\r') {
+		i++
+	}
+	p.pos, p.lit = i, ""
+	if i == len(p.src) {
+		p.tok, p.next = tok_EOF, i
+		return nil
+	}
+	two := func(c byte, t token) error {
+		if i+1 < len(p.src) && p.src[i+1] == c {
+			p.tok, p.next = t, i+2
+			return nil
+		}
+		return p.errorf("expected %q", string([]byte{c, c}))
+	}
+	switch c := p.src[i]; {
+	case c == '(':
+		p.tok = tok_LPAREN
+	case c == ')':
+		p.tok = tok_RPAREN
+	case c == '{':
+		p.tok = tok_LBRACE
+	case c == '}':
+		p.tok = tok_RBRACE
+	case c == ',':
+		p.tok = tok_COMMA
+	case c == ':':
+		p.tok = tok_COLON
+	case c == '!':
+		p.tok = tok_NOT
+	case c == '&':
+		return two('&', tok_AND)
+	case c == '|':
+		return two('|', tok_OR)
+	case c == '"':
+		j := i + 1
+		for ; j < len(p.src) && p.src[j] != '"'; j++ {
+			if p.src[j] == '\\' {
+				j++
+			}
+		}
+		if j >= len(p.src) {
+			return p.errorf("unterminated string")
+		}
+		s, err := strconv.Unquote(p.src[i : j+1])
+		if err != nil {
+			return p.errorf("invalid string %s", p.src[i:j+1])
+		}
+		p.tok, p.lit, p.next = tok_STRING, s, j+1
+		return nil
+	case '0' <= c && c <= '9':
+		j := i
+		for j < len(p.src) && '0' <= p.src[j] && p.src[j] <= '9' {
+			j++
+		}
+		if j < len(p.src) && p.src[j] == '.' {
+			for j++; j < len(p.src) && '0' <= p.src[j] && p.src[j] <= '9'; j++ {
+			}
+		}
+		p.tok, p.lit, p.next = tok_NUMBER, p.src[i:j], j
+		return nil
+	case is_ident_char(c):
+		j := i + 1
+		for j < len(p.src) && is_ident_char(p.src[j]) {
+			j++
+		}
+		p.tok, p.lit, p.next = tok_IDENT, p.src[i:j], j
+		return nil
+	default:
+		return p.errorf("unexpected character %q", c)
+	}
+	p.next = i + 1
+	return nil
+}
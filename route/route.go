@@ -0,0 +1,415 @@
+// Package route models fq routing programs, the rules handed to the
+// server in a BindReq to select which messages on an exchange are
+// delivered to a queue.
+//
+// A program matches message routes by prefix or exactly, optionally
+// followed by a rule in braces made of filter function calls combined
+// with &&, || and !:
+//
+//	PROGRAM: prefix:STRING [{ RULE }]
+//	PROGRAM: exact:STRING [{ RULE }]
+//	RULE:    (RULE) | RULE && RULE | RULE || RULE | !RULE | CALL
+//	CALL:    function(args)
+//	args:    arg | arg, args
+//	arg:     "string" | true | false | [0-9]+(.[0-9]*)?
+//
+// ! binds tighter than &&, which binds tighter than ||.  Programs may
+// be parsed from their textual form with Parse, or assembled with
+// Prefix and Exact:
+//
+//	prog, err := route.Prefix("check.").
+//		Where(route.And(route.Call("route_contains", "cpu"), route.Call("sample", 0.1))).
+//		Compile()
+//
+// Either way the result has been checked against the signatures of
+// the filter functions known to the server (see RegisterFunc) and can
+// be used as the Route of an fq.BindReq or evaluated locally by Match.
+package route
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"github.com/postwait/gofq"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Kind selects how a Program's pattern is compared to message routes.
+type Kind int
+
+const (
+	// PrefixMatch accepts routes beginning with the pattern.
+	PrefixMatch Kind = iota
+	// ExactMatch accepts only routes equal to the pattern.
+	ExactMatch
+)
+
+func (k Kind) String() string {
+	switch k {
+	case PrefixMatch:
+		return "prefix"
+	case ExactMatch:
+		return "exact"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// ArgType is the type of a filter function argument, named by the
+// letter fqd uses in function signatures.
+type ArgType byte
+
+const (
+	String ArgType = 's'
+	Number ArgType = 'd'
+	Bool   ArgType = 'b'
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case String:
+		return "string"
+	case Number:
+		return "number"
+	case Bool:
+		return "bool"
+	}
+	return fmt.Sprintf("ArgType(%q)", byte(t))
+}
+
+// Arg is a single, typed filter function argument.  Only the field
+// selected by Type is meaningful.
+type Arg struct {
+	Type ArgType
+	Str  string
+	Num  float64
+	Bool bool
+}
+
+func (a Arg) String() string {
+	switch a.Type {
+	case String:
+		return strconv.Quote(a.Str)
+	case Number:
+		return strconv.FormatFloat(a.Num, 'f', -1, 64)
+	case Bool:
+		return strconv.FormatBool(a.Bool)
+	}
+	return "?"
+}
+
+// Expr is a node in a Program's rule: a *FuncCall, *NotExpr,
+// *AndExpr or *OrExpr.
+type Expr interface {
+	String() string
+	compile() (cond, error)
+}
+
+// cond is an Expr compiled against the filter functions known when
+// its Program was compiled.
+type cond func(msg *fq.Message, m mode) bool
+
+// FuncCall invokes a filter function.
+type FuncCall struct {
+	Name string
+	Args []Arg
+	// Pos is the byte offset of the call within the parsed program,
+	// or -1 for calls built with Call.
+	Pos int
+	err error
+}
+
+// NotExpr negates X.
+type NotExpr struct{ X Expr }
+
+// AndExpr requires both X and Y.
+type AndExpr struct{ X, Y Expr }
+
+// OrExpr requires either X or Y.
+type OrExpr struct{ X, Y Expr }
+
+// badExpr stands in for an Expr that could not be built, such as an
+// And of nothing, so that Compile can report err.
+type badExpr struct{ err error }
+
+func (e *FuncCall) String() string {
+	args := make([]string, len(e.Args))
+	for i, a := range e.Args {
+		args[i] = a.String()
+	}
+	return e.Name + "(" + strings.Join(args, ",") + ")"
+}
+func (e *NotExpr) String() string { return "!" + e.X.String() }
+func (e *AndExpr) String() string { return "(" + e.X.String() + " && " + e.Y.String() + ")" }
+func (e *OrExpr) String() string  { return "(" + e.X.String() + " || " + e.Y.String() + ")" }
+func (e *badExpr) String() string { return "?" }
+
+// Signature returns the argument types of the call in fqd's notation,
+// e.g. "sd" for a string followed by a number.
+func (e *FuncCall) Signature() string {
+	sig := make([]byte, len(e.Args))
+	for i, a := range e.Args {
+		sig[i] = byte(a.Type)
+	}
+	return string(sig)
+}
+
+// compile checks the call against the known signatures and resolves
+// it to the function's implementation, leaving e untouched.
+func (e *FuncCall) compile() (cond, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	if !valid_ident(e.Name) {
+		return nil, e.errorf("invalid function name %q", e.Name)
+	}
+	for _, a := range e.Args {
+		if a.Type == Number && (a.Num < 0 || math.IsInf(a.Num, 0) || math.IsNaN(a.Num)) {
+			return nil, e.errorf("%s: numbers must be finite and not negative", e.Name)
+		}
+	}
+	funcs_mu.RLock()
+	impls, ok := funcs[e.Name]
+	funcs_mu.RUnlock()
+	if !ok {
+		return nil, e.errorf("unknown function %s", e.Name)
+	}
+	sig := e.Signature()
+	var sigs []string
+	for _, f := range impls {
+		if f.sig == sig {
+			return call_cond(f, append([]Arg(nil), e.Args...)), nil
+		}
+		sigs = append(sigs, f.sig)
+	}
+	return nil, e.errorf("no signature %s(%s); have %s", e.Name, sig, strings.Join(sigs, ", "))
+}
+func (e *NotExpr) compile() (cond, error) {
+	x, err := e.X.compile()
+	if err != nil {
+		return nil, err
+	}
+	return not_cond(x), nil
+}
+func (e *AndExpr) compile() (cond, error) {
+	x, y, err := compile2(e.X, e.Y)
+	if err != nil {
+		return nil, err
+	}
+	return and_cond(x, y), nil
+}
+func (e *OrExpr) compile() (cond, error) {
+	x, y, err := compile2(e.X, e.Y)
+	if err != nil {
+		return nil, err
+	}
+	return or_cond(x, y), nil
+}
+func (e *badExpr) compile() (cond, error) { return nil, e.err }
+
+func compile2(x, y Expr) (cond, cond, error) {
+	cx, err := x.compile()
+	if err != nil {
+		return nil, nil, err
+	}
+	cy, err := y.compile()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cx, cy, nil
+}
+
+func (e *FuncCall) errorf(format string, args ...interface{}) error {
+	if e.Pos < 0 {
+		return fmt.Errorf("route: "+format, args...)
+	}
+	return &SyntaxError{Offset: e.Pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Call returns a call of the named filter function.  Arguments may be
+// strings, bools or (non negative) numbers of any Go numeric type;
+// anything else is reported by Compile.
+func Call(name string, args ...interface{}) *FuncCall {
+	e := &FuncCall{Name: name, Pos: -1}
+	for _, v := range args {
+		a := Arg{Type: Number}
+		switch v := v.(type) {
+		case string:
+			a = Arg{Type: String, Str: v}
+		case bool:
+			a = Arg{Type: Bool, Bool: v}
+		case int:
+			a.Num = float64(v)
+		case int8:
+			a.Num = float64(v)
+		case int16:
+			a.Num = float64(v)
+		case int32:
+			a.Num = float64(v)
+		case int64:
+			a.Num = float64(v)
+		case uint:
+			a.Num = float64(v)
+		case uint8:
+			a.Num = float64(v)
+		case uint16:
+			a.Num = float64(v)
+		case uint32:
+			a.Num = float64(v)
+		case uint64:
+			a.Num = float64(v)
+		case float32:
+			a.Num = float64(v)
+		case float64:
+			a.Num = v
+		default:
+			if e.err == nil {
+				e.err = fmt.Errorf("route: %s: unsupported argument type %T", name, v)
+			}
+		}
+		e.Args = append(e.Args, a)
+	}
+	return e
+}
+
+// Not negates x.
+func Not(x Expr) Expr { return &NotExpr{X: x} }
+
+// And requires all of xs.  An And of nothing is reported as an error
+// by Compile.
+func And(xs ...Expr) Expr {
+	if len(xs) == 0 {
+		return &badExpr{fmt.Errorf("route: And of no expressions")}
+	}
+	e := xs[0]
+	for _, y := range xs[1:] {
+		e = &AndExpr{X: e, Y: y}
+	}
+	return e
+}
+
+// Or requires any of xs.  An Or of nothing is reported as an error
+// by Compile.
+func Or(xs ...Expr) Expr {
+	if len(xs) == 0 {
+		return &badExpr{fmt.Errorf("route: Or of no expressions")}
+	}
+	e := xs[0]
+	for _, y := range xs[1:] {
+		e = &OrExpr{X: e, Y: y}
+	}
+	return e
+}
+
+// Program is a compiled routing program.  Programs are immutable and
+// safe for concurrent use.
+type Program struct {
+	Kind    Kind
+	Pattern string
+	// Rule is nil if the program has no filter.
+	Rule  Expr
+	text  string
+	match cond
+}
+
+// String returns the program in the form sent to the server.
+func (p *Program) String() string {
+	return p.text
+}
+
+func (p *Program) format() string {
+	s := p.Kind.String() + ":" + strconv.Quote(p.Pattern)
+	if p.Rule != nil {
+		s += " {" + p.Rule.String() + "}"
+	}
+	return s
+}
+
+// Builder assembles a Program.
+type Builder struct {
+	kind    Kind
+	pattern string
+	rule    Expr
+}
+
+// Prefix starts a program accepting routes beginning with pattern.
+func Prefix(pattern string) *Builder {
+	return &Builder{kind: PrefixMatch, pattern: pattern}
+}
+
+// Exact starts a program accepting only the route pattern.
+func Exact(pattern string) *Builder {
+	return &Builder{kind: ExactMatch, pattern: pattern}
+}
+
+// Where adds a rule to the program.  Calling it more than once
+// requires all of the rules.
+func (b *Builder) Where(rule Expr) *Builder {
+	if b.rule != nil {
+		rule = And(b.rule, rule)
+	}
+	b.rule = rule
+	return b
+}
+
+// Compile checks the program's function calls against the known
+// signatures and returns the Program.
+func (b *Builder) Compile() (*Program, error) {
+	p := &Program{Kind: b.kind, Pattern: b.pattern, Rule: b.rule}
+	if p.Rule != nil {
+		match, err := p.Rule.compile()
+		if err != nil {
+			return nil, err
+		}
+		p.match = match
+	}
+	p.text = p.format()
+	return p, nil
+}
+
+// MustCompile is like Compile but panics if the program is invalid.
+func (b *Builder) MustCompile() *Program {
+	p, err := b.Compile()
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func is_ident_char(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func valid_ident(s string) bool {
+	if s == "" || ('0' <= s[0] && s[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !is_ident_char(s[i]) {
+			return false
+		}
+	}
+	return true
+}
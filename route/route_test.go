@@ -0,0 +1,212 @@
+package route_test
+
+import (
+	"errors"
+	"github.com/postwait/gofq"
+	"github.com/postwait/gofq/route"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`prefix:""`, `prefix:""`},
+		{`exact:"test.gotest.oneoff"`, `exact:"test.gotest.oneoff"`},
+		{`prefix : "a\"b"`, `prefix:"a\"b"`},
+		{`prefix:"check." {route_contains("cpu")}`, `prefix:"check." {route_contains("cpu")}`},
+		{`prefix:"" { sample(0.25) }`, `prefix:"" {sample(0.25)}`},
+		{`prefix:"" {sample(10.)}`, `prefix:"" {sample(10)}`},
+		{`prefix:"" {!sample(1)}`, `prefix:"" {!sample(1)}`},
+		{`prefix:"" {route_contains("a") && route_contains("b") || sample(1)}`,
+			`prefix:"" {((route_contains("a") && route_contains("b")) || sample(1))}`},
+		{`prefix:"" {route_contains("a") && (route_contains("b") || !sample(1))}`,
+			`prefix:"" {(route_contains("a") && (route_contains("b") || !sample(1)))}`},
+	}
+	for _, tt := range tests {
+		p, err := route.Parse(tt.src)
+		if err != nil {
+			t.Errorf("Parse(%s): %v", tt.src, err)
+			continue
+		}
+		if p.String() != tt.want {
+			t.Errorf("Parse(%s) = %s, want %s", tt.src, p, tt.want)
+		}
+		if again := route.MustParse(p.String()); again.String() != p.String() {
+			t.Errorf("%s does not round trip: %s", p, again)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src    string
+		offset int
+	}{
+		{``, 0},
+		{`prefx:"a"`, 0},
+		{`prefix"a"`, 6},
+		{`prefix:a`, 7},
+		{`prefix:"a`, 7},
+		{`prefix:"\q"`, 7},
+		{`prefix:"a" route_contains("b")`, 11},
+		{`prefix:"a" {}`, 12},
+		{`prefix:"a" {route_contains("b")`, 31},
+		{`prefix:"a" {route_contains("b") & sample(1)}`, 32},
+		{`prefix:"a" {route_contains("b") && }`, 35},
+		{`prefix:"a" {route_contains(b)}`, 27},
+		{`prefix:"a" {route_contains("b" "c")}`, 31},
+		{`prefix:"a" {(sample(1)}`, 22},
+		{`prefix:"a" {sample(1) && no_such_func()}`, 25},
+		{`prefix:"a" {sample(1) || route_contains(1)}`, 25},
+		{`prefix:"a" {sample(1)} x`, 23},
+		{`prefix:"a" {sample(1) # 2}`, 22},
+	}
+	for _, tt := range tests {
+		_, err := route.Parse(tt.src)
+		var se *route.SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("Parse(%s): expected a SyntaxError, got %v", tt.src, err)
+			continue
+		}
+		if se.Offset != tt.offset {
+			t.Errorf("Parse(%s): error at offset %d, want %d (%v)", tt.src, se.Offset, tt.offset, err)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	p, err := route.Prefix("check.").
+		Where(route.Or(route.Call("route_contains", "cpu"), route.Call("route_contains", "mem"))).
+		Where(route.Not(route.Call("sample", 0.5))).
+		Compile()
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	want := `prefix:"check." {((route_contains("cpu") || route_contains("mem")) && !sample(0.5))}`
+	if p.String() != want {
+		t.Errorf("got %s, want %s", p, want)
+	}
+	if p.Kind != route.PrefixMatch || p.Pattern != "check." {
+		t.Errorf("unexpected kind %v or pattern %q", p.Kind, p.Pattern)
+	}
+	if p := route.Exact("a.b").MustCompile(); p.String() != `exact:"a.b"` {
+		t.Errorf("got %s", p)
+	}
+
+	bad := []*route.Builder{
+		route.Prefix("").Where(route.Call("sample", "0.5")),
+		route.Prefix("").Where(route.Call("sample", -1)),
+		route.Prefix("").Where(route.Call("sample", struct{}{})),
+		route.Prefix("").Where(route.Call("bogus")),
+		route.Prefix("").Where(route.Call("not valid", 1)),
+		route.Prefix("").Where(route.And()),
+		route.Prefix("").Where(route.Or()),
+	}
+	for _, b := range bad {
+		if p, err := b.Compile(); err == nil {
+			t.Errorf("expected %s to fail", p)
+		}
+	}
+}
+
+func TestCompileShared(t *testing.T) {
+	rule := route.And(route.Call("route_contains", "cpu"), route.Not(route.Call("sample", 0)))
+	msg := fq.NewMessage("logging", "check.cpu.load", nil)
+	done := make(chan *route.Program)
+	for i := 0; i < 4; i++ {
+		go func() {
+			done <- route.Prefix("check.").Where(rule).MustCompile()
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if p := <-done; !p.Match(msg) {
+			t.Errorf("%s did not match", p)
+		}
+	}
+}
+
+func TestMayMatch(t *testing.T) {
+	msg := fq.NewMessage("logging", "check.cpu.load", nil)
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`prefix:"check." {sample(0)}`, true},
+		{`prefix:"check." {!sample(1)}`, true},
+		{`prefix:"nope" {sample(1)}`, false},
+		{`prefix:"" {route_contains("mem") && sample(0.5)}`, false},
+		{`prefix:"" {route_contains("cpu") && sample(0.5)}`, true},
+		{`prefix:"" {!(route_contains("cpu") || sample(0.5))}`, false},
+		{`prefix:"" {!(route_contains("mem") && sample(0.5))}`, true},
+		{`prefix:"" {route_contains("mem")}`, false},
+	}
+	for _, tt := range tests {
+		p := route.MustParse(tt.src)
+		for i := 0; i < 20; i++ {
+			if got := p.MayMatch(msg); got != tt.want {
+				t.Errorf("%s.MayMatch = %v, want %v", tt.src, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	src := `prefix:"" {substr_eq(9.3,10,"tailorings",true)}`
+	if _, err := route.Parse(src); err == nil {
+		t.Fatalf("substr_eq should be unknown")
+	}
+	if err := route.RegisterFunc("substr_eq", "ddsb", nil); err != nil {
+		t.Fatalf("RegisterFunc: %v", err)
+	}
+	if _, err := route.Parse(src); err != nil {
+		t.Errorf("Parse: %v", err)
+	}
+	if err := route.RegisterFunc("substr_eq", "x", nil); err == nil {
+		t.Errorf("invalid signature accepted")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	msg := fq.NewMessage("logging", "check.cpu.load", []byte("value=42"))
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`prefix:""`, true},
+		{`prefix:"check."`, true},
+		{`prefix:"checks."`, false},
+		{`exact:"check.cpu.load"`, true},
+		{`exact:"check.cpu"`, false},
+		{`prefix:"check." {route_contains("cpu")}`, true},
+		{`prefix:"check." {route_contains("mem")}`, false},
+		{`prefix:"check." {!route_contains("mem")}`, true},
+		{`prefix:"" {route_prefix("check.cpu")}`, true},
+		{`prefix:"" {payload_prefix("value=")}`, true},
+		{`prefix:"" {payload_contains("43")}`, false},
+		{`prefix:"" {route_contains("mem") || payload_contains("42")}`, true},
+		{`prefix:"" {route_contains("cpu") && payload_contains("43")}`, false},
+		{`prefix:"" {sample(1)}`, true},
+		{`prefix:"" {sample(0)}`, false},
+		{`prefix:"nope" {sample(1)}`, false},
+	}
+	for _, tt := range tests {
+		if got := route.MustParse(tt.src).Match(msg); got != tt.want {
+			t.Errorf("%s.Match = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+
+	err := route.RegisterFunc("payload_len_gt", "d", func(m *fq.Message, args []route.Arg) bool {
+		return float64(len(m.Payload)) > args[0].Num
+	})
+	if err != nil {
+		t.Fatalf("RegisterFunc: %v", err)
+	}
+	if !route.MustParse(`prefix:"" {payload_len_gt(7)}`).Match(msg) {
+		t.Errorf("registered function did not match")
+	}
+	if route.MustParse(`prefix:"" {payload_len_gt(8)}`).Match(msg) {
+		t.Errorf("registered function matched")
+	}
+}
@@ -0,0 +1,439 @@
+package wire
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// buffer_size is the size of the buffer a Decoder reads through.
+const buffer_size = 64 * 1024
+
+// Encoder writes fq frames to an io.Writer, each with a single Write.
+// It is not safe for concurrent use.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+	// Peer selects the peer format for EncodeMessage.
+	Peer bool
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) flush(err error) error {
+	if err == nil {
+		_, err = e.w.Write(e.buf)
+	}
+	e.buf = e.buf[:0]
+	return err
+}
+
+// EncodeMode writes the mode that opens a connection.
+func (e *Encoder) EncodeMode(mode Mode) error {
+	e.buf = be.AppendUint32(e.buf[:0], uint32(mode))
+	return e.flush(nil)
+}
+
+// EncodeSessionKey writes the session key with which a data
+// connection follows its mode.
+func (e *Encoder) EncodeSessionKey(key []byte) error {
+	var err error
+	e.buf, err = append_short(e.buf[:0], "key", string(key))
+	return e.flush(err)
+}
+
+// Encode writes a command frame.
+func (e *Encoder) Encode(f Frame) error {
+	var err error
+	e.buf, err = AppendFrame(e.buf[:0], f)
+	return e.flush(err)
+}
+
+// EncodeMessage writes a message.
+func (e *Encoder) EncodeMessage(m *Message) error {
+	var err error
+	e.buf, err = AppendMessage(e.buf[:0], m, e.Peer)
+	return e.flush(err)
+}
+
+// AppendMessage appends the encoding of m to b, in the peer format if
+// peer is set.
+func AppendMessage(b []byte, m *Message, peer bool) ([]byte, error) {
+	if m.Exchange.Len > MaxRkLen || m.Route.Len > MaxRkLen || m.Sender.Len > MaxRkLen {
+		return b, fmt.Errorf("wire: name longer than %d bytes", MaxRkLen)
+	}
+	if len(m.Hops) > 0xff {
+		return b, fmt.Errorf("wire: too many hops: %d", len(m.Hops))
+	}
+	if uint64(len(m.Payload)) > 0xffffffff {
+		return b, fmt.Errorf("wire: payload too large: %d", len(m.Payload))
+	}
+	b = append(b, m.Exchange.Len)
+	b = append(b, m.Exchange.Bytes()...)
+	b = append(b, m.Route.Len)
+	b = append(b, m.Route.Bytes()...)
+	b = append(b, m.ID[:]...)
+	if peer {
+		b = append(b, m.Sender.Len)
+		b = append(b, m.Sender.Bytes()...)
+		b = append(b, uint8(len(m.Hops)))
+		for _, hop := range m.Hops {
+			b = ne.AppendUint32(b, hop)
+		}
+	}
+	b = be.AppendUint32(b, uint32(len(m.Payload)))
+	return append(b, m.Payload...), nil
+}
+
+// Decoder reads fq frames from an io.Reader.  It reads ahead, so once
+// a Decoder has been used the underlying reader must only be read
+// through it.  It is not safe for concurrent use.
+//
+// Input is not trusted: malformed frames yield errors rather than
+// panics, and a frame exceeding the Decoder's limits yields a
+// *LimitError before its contents are read.
+type Decoder struct {
+	r *bufio.Reader
+	// Peer selects the peer format for DecodeMessage.  Clients
+	// always receive messages in the peer format.
+	Peer bool
+	// MaxPayload is the largest payload DecodeMessage accepts.
+	// Zero means DefaultMaxPayload.
+	MaxPayload int
+	// MaxHops is the most hops DecodeMessage accepts.  Zero means
+	// the protocol's MaxHops.
+	MaxHops int
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok || br.Size() < 4096 {
+		br = bufio.NewReaderSize(r, buffer_size)
+	}
+	return &Decoder{r: br}
+}
+
+// next returns the next n bytes, valid until the next read.  n must
+// not exceed the buffer size.
+func (d *Decoder) next(n int) ([]byte, error) {
+	b, err := d.r.Peek(n)
+	if err != nil {
+		return nil, err
+	}
+	d.r.Discard(n)
+	return b, nil
+}
+
+func (d *Decoder) uint8() (uint8, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) uint16() (uint16, error) {
+	b, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return be.Uint16(b), nil
+}
+
+func (d *Decoder) uint32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return be.Uint32(b), nil
+}
+
+// read reads n bytes into b, reusing its memory if it is large
+// enough.  Otherwise memory is allocated as the data arrives, so that
+// a bogus length cannot cause a huge allocation on its own.
+func (d *Decoder) read(b []byte, n int) ([]byte, error) {
+	if cap(b) >= n {
+		b = b[:n]
+		_, err := io.ReadFull(d.r, b)
+		return b, err
+	}
+	b = b[:0]
+	for len(b) < n {
+		chunk := min(n-len(b), max(len(b), buffer_size))
+		m := len(b)
+		b = slices.Grow(b, chunk)[:m+chunk]
+		if _, err := io.ReadFull(d.r, b[m:]); err != nil {
+			return b[:m], err
+		}
+	}
+	return b, nil
+}
+
+func (d *Decoder) short() ([]byte, error) {
+	n, err := d.uint16()
+	if err != nil {
+		return nil, err
+	}
+	return d.read(nil, int(n))
+}
+
+func (d *Decoder) rk(rk *Rk) error {
+	n, err := d.uint8()
+	if err != nil {
+		return err
+	}
+	if n > MaxRkLen {
+		return fmt.Errorf("wire: name longer than %d bytes: %d", MaxRkLen, n)
+	}
+	b, err := d.next(int(n))
+	if err != nil {
+		return err
+	}
+	rk.Len = uint8(copy(rk.Name[:], b))
+	// leave no trace of a longer name decoded into rk before, so
+	// that Rks compare equal by value
+	clear(rk.Name[rk.Len:])
+	return nil
+}
+
+// unexpected turns the end of input partway through a frame into
+// io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// DecodeMode reads the mode that opens a connection.
+func (d *Decoder) DecodeMode() (Mode, error) {
+	if _, err := d.r.Peek(1); err != nil {
+		return 0, err
+	}
+	v, err := d.uint32()
+	return Mode(v), unexpected(err)
+}
+
+// DecodeSessionKey reads the session key with which a data connection
+// follows its mode.
+func (d *Decoder) DecodeSessionKey() ([]byte, error) {
+	key, err := d.short()
+	return key, unexpected(err)
+}
+
+// Decode reads a command frame.  It returns io.EOF only if the input
+// ends before the frame, and an *UnknownCommandError for a command it
+// does not know.
+func (d *Decoder) Decode() (Frame, error) {
+	if _, err := d.r.Peek(1); err != nil {
+		return nil, err
+	}
+	cmd, err := d.uint16()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	var f Frame
+	switch Command(cmd) {
+	case CmdAuth:
+		f, err = d.auth()
+	case CmdAuthResponse:
+		var key []byte
+		key, err = d.short()
+		f = &AuthResponse{Key: key}
+	case CmdError:
+		var reason []byte
+		reason, err = d.short()
+		f = &Error{Reason: string(reason)}
+	case CmdHeartbeatReq:
+		var ms uint16
+		ms, err = d.uint16()
+		f = &HeartbeatRequest{Interval: time.Duration(ms) * time.Millisecond}
+	case CmdHeartbeat:
+		f = &Heartbeat{}
+	case CmdBindReq:
+		f, err = d.bind_request()
+	case CmdBind:
+		var id uint32
+		id, err = d.uint32()
+		f = &BindResponse{RouteID: id}
+	case CmdUnbindReq:
+		f, err = d.unbind_request()
+	case CmdUnbind:
+		var success uint32
+		success, err = d.uint32()
+		f = &UnbindResponse{Success: success}
+	case CmdStatusReq:
+		f = &StatusRequest{}
+	case CmdStatus:
+		f, err = d.status()
+	default:
+		return nil, &UnknownCommandError{Command: Command(cmd)}
+	}
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	return f, nil
+}
+
+func (d *Decoder) auth() (Frame, error) {
+	scheme, err := d.uint16()
+	if err != nil {
+		return nil, err
+	}
+	if scheme != AuthPlain {
+		return nil, fmt.Errorf("wire: unknown auth scheme %d", scheme)
+	}
+	f := &Auth{}
+	user, err := d.short()
+	if err != nil {
+		return nil, err
+	}
+	queue, err := d.short()
+	if err != nil {
+		return nil, err
+	}
+	pass, err := d.short()
+	if err != nil {
+		return nil, err
+	}
+	f.User, f.Password = string(user), string(pass)
+	f.Queue, f.QueueType = split_queue(queue)
+	return f, nil
+}
+
+func (d *Decoder) bind_request() (Frame, error) {
+	flags, err := d.uint16()
+	if err != nil {
+		return nil, err
+	}
+	exchange, err := d.short()
+	if err != nil {
+		return nil, err
+	}
+	program, err := d.short()
+	if err != nil {
+		return nil, err
+	}
+	return &BindRequest{Flags: flags, Exchange: string(exchange), Program: string(program)}, nil
+}
+
+func (d *Decoder) unbind_request() (Frame, error) {
+	id, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	exchange, err := d.short()
+	if err != nil {
+		return nil, err
+	}
+	return &UnbindRequest{RouteID: id, Exchange: string(exchange)}, nil
+}
+
+func (d *Decoder) status() (Frame, error) {
+	f := &Status{Stats: make(map[string]uint32)}
+	for n := 1; ; n++ {
+		name, err := d.short()
+		if err != nil {
+			return nil, err
+		}
+		if len(name) == 0 {
+			return f, nil
+		}
+		if n > max_stats {
+			return nil, &LimitError{What: "status entries", Size: uint64(n), Limit: max_stats}
+		}
+		if f.Stats[string(name)], err = d.uint32(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// DecodeMessage reads a message into m, reusing the memory of its
+// Hops and Payload.  It returns io.EOF only if the input ends before
+// the message.
+func (d *Decoder) DecodeMessage(m *Message) error {
+	if _, err := d.r.Peek(1); err != nil {
+		return err
+	}
+	return unexpected(d.message(m))
+}
+
+func (d *Decoder) message(m *Message) error {
+	if err := d.rk(&m.Exchange); err != nil {
+		return err
+	}
+	if err := d.rk(&m.Route); err != nil {
+		return err
+	}
+	id, err := d.next(len(m.ID))
+	if err != nil {
+		return err
+	}
+	copy(m.ID[:], id)
+	m.Sender, m.Hops = Rk{}, m.Hops[:0]
+	if d.Peer {
+		if err := d.rk(&m.Sender); err != nil {
+			return err
+		}
+		n, err := d.uint8()
+		if err != nil {
+			return err
+		}
+		if limit := or(d.MaxHops, MaxHops); int(n) > limit {
+			return &LimitError{What: "hops", Size: uint64(n), Limit: limit}
+		}
+		hops, err := d.next(4 * int(n))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < int(n); i++ {
+			m.Hops = append(m.Hops, ne.Uint32(hops[4*i:]))
+		}
+	}
+	n, err := d.uint32()
+	if err != nil {
+		return err
+	}
+	if limit := or(d.MaxPayload, DefaultMaxPayload); uint64(n) > uint64(limit) {
+		return &LimitError{What: "payload", Size: uint64(n), Limit: limit}
+	}
+	m.Payload, err = d.read(m.Payload, int(n))
+	return err
+}
+
+// or returns limit, or def if limit is not set.
+func or(limit, def int) int {
+	if limit <= 0 {
+		return def
+	}
+	return limit
+}
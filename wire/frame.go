@@ -0,0 +1,201 @@
+package wire
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Frame is a command frame.  The frame types of this package are the
+// only implementations.
+type Frame interface {
+	Command() Command
+	append(b []byte) ([]byte, error)
+}
+
+// Auth authenticates a command connection and names the queue the
+// session's messages are delivered to.  An empty QueueType leaves the
+// choice to the server.
+type Auth struct {
+	User, Password   string
+	Queue, QueueType string
+}
+
+// AuthResponse accepts an Auth, returning the key the session's data
+// connection presents.
+type AuthResponse struct {
+	Key []byte
+}
+
+// Error rejects an Auth.  The server hangs up after sending it.
+type Error struct {
+	Reason string
+}
+
+// HeartbeatRequest asks the receiver to send a Heartbeat every
+// Interval, which is carried in whole milliseconds.
+type HeartbeatRequest struct {
+	Interval time.Duration
+}
+
+// Heartbeat shows that the sender is alive.
+type Heartbeat struct{}
+
+// BindRequest asks for messages on Exchange matching Program to be
+// routed to the session's queue.
+type BindRequest struct {
+	Flags    uint16
+	Exchange string
+	Program  string
+}
+
+// BindResponse answers a BindRequest with the id of the new route,
+// 0xffffffff if it was refused.
+type BindResponse struct {
+	RouteID uint32
+}
+
+// UnbindRequest asks for a route to be removed.
+type UnbindRequest struct {
+	RouteID  uint32
+	Exchange string
+}
+
+// UnbindResponse answers an UnbindRequest; Success is nonzero if the
+// route was removed.
+type UnbindResponse struct {
+	Success uint32
+}
+
+// StatusRequest asks the server for its counters.
+type StatusRequest struct{}
+
+// Status answers a StatusRequest.  Counters are encoded in order of
+// name.
+type Status struct {
+	Stats map[string]uint32
+}
+
+func (*Auth) Command() Command             { return CmdAuth }
+func (*AuthResponse) Command() Command     { return CmdAuthResponse }
+func (*Error) Command() Command            { return CmdError }
+func (*HeartbeatRequest) Command() Command { return CmdHeartbeatReq }
+func (*Heartbeat) Command() Command        { return CmdHeartbeat }
+func (*BindRequest) Command() Command      { return CmdBindReq }
+func (*BindResponse) Command() Command     { return CmdBind }
+func (*UnbindRequest) Command() Command    { return CmdUnbindReq }
+func (*UnbindResponse) Command() Command   { return CmdUnbind }
+func (*StatusRequest) Command() Command    { return CmdStatusReq }
+func (*Status) Command() Command           { return CmdStatus }
+
+// AppendFrame appends the encoding of f to b.
+func AppendFrame(b []byte, f Frame) ([]byte, error) {
+	return f.append(be.AppendUint16(b, uint16(f.Command())))
+}
+
+// append_short appends data prefixed with its 16 bit length.
+func append_short(b []byte, what string, data string) ([]byte, error) {
+	if len(data) > 0xffff {
+		return b, fmt.Errorf("wire: %s longer than 65535 bytes: %d", what, len(data))
+	}
+	b = be.AppendUint16(b, uint16(len(data)))
+	return append(b, data...), nil
+}
+
+func (f *Auth) append(b []byte) (out []byte, err error) {
+	b = be.AppendUint16(b, AuthPlain)
+	if b, err = append_short(b, "user", f.User); err != nil {
+		return b, err
+	}
+	if b, err = append_short(b, "queue", f.Queue+"\x00"+f.QueueType); err != nil {
+		return b, err
+	}
+	return append_short(b, "password", f.Password)
+}
+
+func (f *AuthResponse) append(b []byte) ([]byte, error) {
+	return append_short(b, "key", string(f.Key))
+}
+
+func (f *Error) append(b []byte) ([]byte, error) {
+	return append_short(b, "reason", f.Reason)
+}
+
+func (f *HeartbeatRequest) append(b []byte) ([]byte, error) {
+	ms := f.Interval / time.Millisecond
+	if ms < 0 || ms > 0xffff {
+		return b, fmt.Errorf("wire: heartbeat interval out of range: %v", f.Interval)
+	}
+	return be.AppendUint16(b, uint16(ms)), nil
+}
+
+func (f *Heartbeat) append(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (f *BindRequest) append(b []byte) (out []byte, err error) {
+	b = be.AppendUint16(b, f.Flags)
+	if b, err = append_short(b, "exchange", f.Exchange); err != nil {
+		return b, err
+	}
+	return append_short(b, "program", f.Program)
+}
+
+func (f *BindResponse) append(b []byte) ([]byte, error) {
+	return be.AppendUint32(b, f.RouteID), nil
+}
+
+func (f *UnbindRequest) append(b []byte) ([]byte, error) {
+	b = be.AppendUint32(b, f.RouteID)
+	return append_short(b, "exchange", f.Exchange)
+}
+
+func (f *UnbindResponse) append(b []byte) ([]byte, error) {
+	return be.AppendUint32(b, f.Success), nil
+}
+
+func (f *StatusRequest) append(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (f *Status) append(b []byte) (out []byte, err error) {
+	names := make([]string, 0, len(f.Stats))
+	for name := range f.Stats {
+		if name == "" {
+			// an empty name ends the list
+			return b, fmt.Errorf("wire: empty status name")
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if b, err = append_short(b, "status name", name); err != nil {
+			return b, err
+		}
+		b = be.AppendUint32(b, f.Stats[name])
+	}
+	return be.AppendUint16(b, 0), nil
+}
@@ -0,0 +1,157 @@
+// Package wire implements the framing of the fq protocol: the mode
+// handshake that opens every connection, the command frames exchanged
+// on command connections (authentication, heartbeats, binding,
+// unbinding and status) and the messages carried by data connections.
+//
+// An Encoder writes frames to an io.Writer and a Decoder reads them
+// from an io.Reader, so the same framing can be used by clients,
+// servers, proxies and recorders alike.
+package wire
+
+/*
+ * Copyright (c) 2016 Circonus, Inc.
+ * All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to
+ * deal in the Software without restriction, including without limitation the
+ * rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ * sell copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS
+ * IN THE SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Mode is the first word written on a connection, selecting what it
+// is used for.
+type Mode uint32
+
+const (
+	CmdMode     Mode = 0xcc50cafe
+	DataMode    Mode = 0xcc50face
+	PeerMode    Mode = 0xcc50feed
+	OldPeerMode Mode = 0xcc50fade
+)
+
+// Command identifies a frame on a command connection.
+type Command uint16
+
+const (
+	CmdError        Command = 0xeeee
+	CmdAuth         Command = 0xaaaa
+	CmdAuthResponse Command = 0xaa00
+	CmdHeartbeatReq Command = 0x4848
+	CmdHeartbeat    Command = 0xbea7
+	CmdBindReq      Command = 0xb170
+	CmdBind         Command = 0xb171
+	CmdUnbindReq    Command = 0x071b
+	CmdUnbind       Command = 0x171b
+	CmdStatus       Command = 0x57a7
+	CmdStatusReq    Command = 0xc7a7
+)
+
+// AuthPlain is the only authentication scheme.
+const AuthPlain uint16 = 0
+
+// MaxRkLen is the longest exchange, route or sender name.
+const MaxRkLen = 127
+
+// MaxHops is the most hops a message may record.
+const MaxHops = 32
+
+// DefaultMaxPayload is the largest payload a Decoder accepts unless
+// told otherwise.
+const DefaultMaxPayload = 64 * 1024 * 1024
+
+// max_stats bounds the entries of a status frame; fqd reports a
+// handful.
+const max_stats = 4096
+
+var be = binary.BigEndian
+
+// hops are copied to and from the wire in host byte order, as fqd
+// does.
+var ne = binary.NativeEndian
+
+// Rk is an exchange, route or sender name as carried in a message.
+type Rk struct {
+	Name [MaxRkLen]byte
+	Len  uint8
+}
+
+// NewRk returns name as an Rk, or an error if it is too long.
+func NewRk(name string) (Rk, error) {
+	var rk Rk
+	if len(name) > MaxRkLen {
+		return rk, fmt.Errorf("wire: name longer than %d bytes: %d", MaxRkLen, len(name))
+	}
+	rk.Len = uint8(copy(rk.Name[:], name))
+	return rk, nil
+}
+
+// Bytes returns the name, sharing the Rk's memory.
+func (rk *Rk) Bytes() []byte {
+	return rk.Name[:rk.Len]
+}
+
+func (rk Rk) String() string {
+	return string(rk.Name[:rk.Len])
+}
+
+// MsgID identifies a message.  Publishers fill in the first 8 bytes;
+// the server fills in the rest.
+type MsgID [16]byte
+
+// Message is a message as carried on a data connection.  Sender and
+// Hops are only present in the peer format, used by peers and for all
+// messages delivered by the server.
+type Message struct {
+	Exchange, Route, Sender Rk
+	ID                      MsgID
+	Hops                    []uint32
+	Payload                 []byte
+}
+
+// UnknownCommandError is returned by Decoder.Decode for a command it
+// does not know.  Nothing after the command has been read.
+type UnknownCommandError struct {
+	Command Command
+}
+
+func (e *UnknownCommandError) Error() string {
+	return fmt.Sprintf("wire: unknown command 0x%04x", uint16(e.Command))
+}
+
+// LimitError is returned by a Decoder for a frame exceeding one of its
+// limits.  The frame has only been partly read, so the stream cannot
+// be decoded any further.
+type LimitError struct {
+	// What names the limit: "payload", "hops" or "status entries".
+	What  string
+	Size  uint64
+	Limit int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("wire: %s of %d exceeds limit of %d", e.What, e.Size, e.Limit)
+}
+
+func split_queue(queue []byte) (string, string) {
+	name, qtype, _ := bytes.Cut(queue, []byte{0})
+	return string(name), string(qtype)
+}
@@ -0,0 +1,254 @@
+package wire_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/postwait/gofq/wire"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var frames = []wire.Frame{
+	&wire.Auth{User: "gotest", Password: "nopass", Queue: "q", QueueType: "mem"},
+	&wire.Auth{User: "u", Queue: "q"},
+	&wire.AuthResponse{Key: []byte("0123456789abcdef")},
+	&wire.Error{Reason: "auth failed"},
+	&wire.HeartbeatRequest{Interval: time.Second},
+	&wire.Heartbeat{},
+	&wire.BindRequest{Flags: 0x100, Exchange: "logging", Program: `prefix:"a."`},
+	&wire.BindResponse{RouteID: 42},
+	&wire.UnbindRequest{RouteID: 42, Exchange: "logging"},
+	&wire.UnbindResponse{Success: 1},
+	&wire.StatusRequest{},
+	&wire.Status{Stats: map[string]uint32{"routed": 3, "dropped": 0}},
+	&wire.Status{Stats: map[string]uint32{}},
+}
+
+func message(peer bool) *wire.Message {
+	m := &wire.Message{Payload: []byte("payload")}
+	m.Exchange, _ = wire.NewRk("logging")
+	m.Route, _ = wire.NewRk("test.gotest.wire")
+	m.ID[0], m.ID[15] = 1, 2
+	if peer {
+		m.Sender, _ = wire.NewRk("gotest")
+		m.Hops = []uint32{0x7f000001, 0x0a000001}
+	}
+	return m
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	enc := wire.NewEncoder(&buf)
+	if err := enc.EncodeMode(wire.CmdMode); err != nil {
+		t.Fatalf("EncodeMode: %v", err)
+	}
+	for _, f := range frames {
+		if err := enc.Encode(f); err != nil {
+			t.Fatalf("Encode(%#v): %v", f, err)
+		}
+	}
+
+	dec := wire.NewDecoder(&buf)
+	if mode, err := dec.DecodeMode(); err != nil || mode != wire.CmdMode {
+		t.Fatalf("DecodeMode: %x, %v", mode, err)
+	}
+	for _, want := range frames {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("decoded %#v, want %#v", got, want)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	long := string(make([]byte, 0x10000))
+	bad := []wire.Frame{
+		&wire.Auth{User: long},
+		&wire.BindRequest{Program: long},
+		&wire.HeartbeatRequest{Interval: time.Minute + 6*time.Second},
+		&wire.Status{Stats: map[string]uint32{"": 1}},
+	}
+	for _, f := range bad {
+		var buf bytes.Buffer
+		if err := wire.NewEncoder(&buf).Encode(f); err == nil {
+			t.Errorf("Encode(%T) succeeded", f)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Encode(%T) wrote a partial frame", f)
+		}
+	}
+	if _, err := wire.NewRk(string(make([]byte, wire.MaxRkLen+1))); err == nil {
+		t.Errorf("NewRk accepted a long name")
+	}
+}
+
+func TestMessages(t *testing.T) {
+	for _, peer := range []bool{false, true} {
+		var buf bytes.Buffer
+		enc := wire.NewEncoder(&buf)
+		enc.Peer = peer
+		in := message(peer)
+		for i := 0; i < 2; i++ {
+			if err := enc.EncodeMessage(in); err != nil {
+				t.Fatalf("EncodeMessage: %v", err)
+			}
+		}
+		dec := wire.NewDecoder(&buf)
+		dec.Peer = peer
+		var out wire.Message
+		for i := 0; i < 2; i++ {
+			if err := dec.DecodeMessage(&out); err != nil {
+				t.Fatalf("DecodeMessage: %v", err)
+			}
+			if !reflect.DeepEqual(&out, in) && !(len(in.Hops) == 0 && len(out.Hops) == 0) {
+				t.Errorf("peer %v: decoded %+v, want %+v", peer, out, in)
+			}
+		}
+		if err := dec.DecodeMessage(&out); err != io.EOF {
+			t.Errorf("expected EOF, got %v", err)
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	enc := wire.NewEncoder(&buf)
+	enc.Peer = true
+	enc.EncodeMessage(message(true))
+	b := buf.Bytes()
+	for n := 1; n < len(b); n++ {
+		dec := wire.NewDecoder(bytes.NewReader(b[:n]))
+		dec.Peer = true
+		if err := dec.DecodeMessage(&wire.Message{}); err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncated at %d: expected ErrUnexpectedEOF, got %v", n, err)
+		}
+	}
+
+	buf.Reset()
+	enc.Encode(&wire.Status{Stats: map[string]uint32{"routed": 3}})
+	b = buf.Bytes()
+	for n := 1; n < len(b); n++ {
+		if _, err := wire.NewDecoder(bytes.NewReader(b[:n])).Decode(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncated at %d: expected ErrUnexpectedEOF, got %v", n, err)
+		}
+	}
+
+	var unknown *wire.UnknownCommandError
+	if _, err := wire.NewDecoder(bytes.NewReader([]byte{0x12, 0x34})).Decode(); !errors.As(err, &unknown) || unknown.Command != 0x1234 {
+		t.Errorf("expected UnknownCommandError, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var buf bytes.Buffer
+	enc := wire.NewEncoder(&buf)
+	enc.Peer = true
+	m := message(true)
+	m.Payload = make([]byte, 100)
+	enc.EncodeMessage(m)
+	m.Payload = nil
+	m.Hops = make([]uint32, wire.MaxHops+1)
+	enc.EncodeMessage(m)
+	b := buf.Bytes()
+
+	var le *wire.LimitError
+	dec := wire.NewDecoder(bytes.NewReader(b))
+	dec.Peer, dec.MaxPayload = true, 99
+	if err := dec.DecodeMessage(&wire.Message{}); !errors.As(err, &le) || le.What != "payload" || le.Size != 100 {
+		t.Errorf("expected a payload LimitError, got %v", err)
+	}
+	dec = wire.NewDecoder(bytes.NewReader(b))
+	dec.Peer = true
+	if err := dec.DecodeMessage(&wire.Message{}); err != nil {
+		t.Fatalf("DecodeMessage: %v", err)
+	}
+	if err := dec.DecodeMessage(&wire.Message{}); !errors.As(err, &le) || le.What != "hops" {
+		t.Errorf("expected a hops LimitError, got %v", err)
+	}
+
+	// a bogus length is refused before anything is allocated for it
+	huge, _ := wire.AppendMessage(nil, message(false), false)
+	huge = append(huge[:len(huge)-len("payload")-4], 0xff, 0xff, 0xff, 0xff)
+	dec = wire.NewDecoder(bytes.NewReader(huge))
+	if err := dec.DecodeMessage(&wire.Message{}); !errors.As(err, &le) || le.Size != 0xffffffff ||
+		le.Limit != wire.DefaultMaxPayload {
+		t.Errorf("expected a payload LimitError, got %v", err)
+	}
+
+	stats := make(map[string]uint32)
+	for i := 0; i < 5000; i++ {
+		stats[strconv.Itoa(i)] = uint32(i)
+	}
+	sb, _ := wire.AppendFrame(nil, &wire.Status{Stats: stats})
+	if _, err := wire.NewDecoder(bytes.NewReader(sb)).Decode(); !errors.As(err, &le) || le.What != "status entries" {
+		t.Errorf("expected a status LimitError, got %v", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, fr := range frames {
+		b, _ := wire.AppendFrame(nil, fr)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		dec := wire.NewDecoder(bytes.NewReader(b))
+		for {
+			fr, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			// whatever decodes must encode to something that decodes
+			// the same
+			again, err := wire.AppendFrame(nil, fr)
+			if err != nil {
+				t.Fatalf("AppendFrame(%#v): %v", fr, err)
+			}
+			fr2, err := wire.NewDecoder(bytes.NewReader(again)).Decode()
+			if err != nil || !reflect.DeepEqual(fr, fr2) {
+				t.Fatalf("%#v re-decoded as %#v, %v", fr, fr2, err)
+			}
+		}
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, peer := range []bool{false, true} {
+		b, _ := wire.AppendMessage(nil, message(peer), peer)
+		f.Add(peer, b)
+		// claiming a 4GB payload
+		f.Add(peer, append(b[:len(b)-len("payload")-4:len(b)-len("payload")-4], 0xff, 0xff, 0xff, 0xff))
+	}
+	f.Fuzz(func(t *testing.T, peer bool, b []byte) {
+		dec := wire.NewDecoder(bytes.NewReader(b))
+		dec.Peer, dec.MaxPayload, dec.MaxHops = peer, 1024, 4
+		var m wire.Message
+		for dec.DecodeMessage(&m) == nil {
+			if len(m.Payload) > 1024 || len(m.Hops) > 4 {
+				t.Fatalf("limits exceeded: %d bytes, %d hops", len(m.Payload), len(m.Hops))
+			}
+			again, err := wire.AppendMessage(nil, &m, peer)
+			if err != nil {
+				t.Fatalf("AppendMessage: %v", err)
+			}
+			d2 := wire.NewDecoder(bytes.NewReader(again))
+			d2.Peer = peer
+			var m2 wire.Message
+			if err := d2.DecodeMessage(&m2); err != nil {
+				t.Fatalf("re-decoding: %v", err)
+			}
+			if m.Exchange != m2.Exchange || m.Route != m2.Route || m.Sender != m2.Sender ||
+				m.ID != m2.ID || !bytes.Equal(m.Payload, m2.Payload) || len(m.Hops) != len(m2.Hops) {
+				t.Fatalf("%+v re-decoded as %+v", m, m2)
+			}
+		}
+	})
+}